@@ -0,0 +1,185 @@
+package socks
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// accessLogEntry is the JSON line written to Config.AccessLogWriter
+// for every request
+type accessLogEntry struct {
+	Timestamp  string            `json:"timestamp"`
+	ConnID     uint64            `json:"conn_id"`
+	Version    int               `json:"version"`
+	Client     string            `json:"client"`
+	User       string            `json:"user,omitempty"`
+	Command    string            `json:"command"`
+	Dest       string            `json:"dest"`
+	ReplyCode  int               `json:"reply_code"`
+	BytesSent  int64             `json:"bytes_sent"`
+	BytesRecv  int64             `json:"bytes_recv"`
+	DurationMs int64             `json:"duration_ms"`
+	Error      string            `json:"error,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Timings    accessLogTimings  `json:"timings_ms"`
+}
+
+// accessLogTimings are the request phase timings, in milliseconds
+type accessLogTimings struct {
+	Greeting float64 `json:"greeting"`
+	Auth     float64 `json:"auth"`
+	Resolve  float64 `json:"resolve"`
+	Dial     float64 `json:"dial"`
+}
+
+// milliseconds returns d in fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// accessLogConn wraps the client connection of a request to count the
+// bytes exchanged and record the reply code
+type accessLogConn struct {
+	net.Conn
+	sent      int64
+	recv      int64
+	replyCode int32
+}
+
+func newAccessLogConn(conn net.Conn) *accessLogConn {
+	return &accessLogConn{Conn: conn, replyCode: -1}
+}
+
+// Write counts the bytes sent to the client. The first write of a
+// request is its reply, which carries the reply code in its second byte
+func (c *accessLogConn) Write(b []byte) (int, error) {
+	if len(b) >= 2 {
+		atomic.CompareAndSwapInt32(&c.replyCode, -1, int32(b[1]))
+	}
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.sent, int64(n))
+	return n, err
+}
+
+// CloseWrite is used to keep half-closes working through the wrapper
+func (c *accessLogConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// NetConn returns the wrapped connection
+func (c *accessLogConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// reader wraps r to count the bytes received from the client
+func (c *accessLogConn) reader(r io.Reader) io.Reader {
+	return &accessLogReader{r: r, c: c}
+}
+
+type accessLogReader struct {
+	r io.Reader
+	c *accessLogConn
+}
+
+// Buffered reports the data buffered by the wrapped reader
+func (r *accessLogReader) Buffered() int {
+	return bufferedLen(r.r)
+}
+
+func (r *accessLogReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	atomic.AddInt64(&r.c.recv, int64(n))
+	return n, err
+}
+
+// commandName returns the name used for a command in access logs
+func commandName(cmd uint8) string {
+	switch cmd {
+	case ConnectCommand:
+		return "connect"
+	case BindCommand:
+		return "bind"
+	case AssociateCommand:
+		return "associate"
+	case ResolveCommand:
+		return "resolve"
+	case ResolvePTRCommand:
+		return "resolve_ptr"
+	default:
+		return strconv.Itoa(int(cmd))
+	}
+}
+
+// writeAccessLog writes the access log line of a completed request
+func (s *Server) writeAccessLog(start time.Time, c *accessLogConn, req *Request, err error) {
+	now := s.clk().Now()
+	entry := accessLogEntry{
+		Timestamp:  now.UTC().Format(time.RFC3339Nano),
+		ConnID:     req.ConnID,
+		Version:    int(req.Version),
+		Command:    commandName(req.Command),
+		ReplyCode:  int(atomic.LoadInt32(&c.replyCode)),
+		BytesSent:  atomic.LoadInt64(&c.sent),
+		BytesRecv:  atomic.LoadInt64(&c.recv),
+		DurationMs: now.Sub(start).Milliseconds(),
+		Metadata:   req.Metadata,
+		Timings: accessLogTimings{
+			Greeting: milliseconds(req.Timings.Greeting),
+			Auth:     milliseconds(req.Timings.Auth),
+			Resolve:  milliseconds(req.Timings.Resolve),
+			Dial:     milliseconds(req.Timings.Dial),
+		},
+	}
+	if addr := c.RemoteAddr(); addr != nil {
+		entry.Client = addr.String()
+	}
+	if req.AuthContext != nil {
+		entry.User = s.logUser(req)
+	}
+	if req.DestAddr != nil {
+		if req.DestAddr.FQDN != "" {
+			entry.Dest = net.JoinHostPort(req.DestAddr.FQDN, strconv.Itoa(req.DestAddr.Port))
+		} else {
+			entry.Dest = req.DestAddr.Address()
+		}
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	line, jerr := json.Marshal(entry)
+	if jerr != nil {
+		s.config.Logger.Printf("[ERR] socks: conn %d: failed to encode access log: %v", req.ConnID, jerr)
+		return
+	}
+	line = append(line, '\n')
+
+	s.accessLogMu.Lock()
+	defer s.accessLogMu.Unlock()
+	if _, err := s.config.AccessLogWriter.Write(line); err != nil {
+		s.config.Logger.Printf("[ERR] socks: conn %d: failed to write access log: %v", req.ConnID, err)
+	}
+}
+
+// logUser returns the user to log for req. SOCKS4 userids are only
+// logged if Config.LogUserID is set, hashed by Config.HashUserID
+func (s *Server) logUser(req *Request) string {
+	user := req.AuthContext.Payload["Username"]
+	if req.Version != socks4Version || user == "" {
+		return user
+	}
+	if !s.config.LogUserID {
+		return ""
+	}
+	if s.config.HashUserID != nil {
+		return s.config.HashUserID(user)
+	}
+	return user
+}
@@ -0,0 +1,193 @@
+package socks
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAccessLog_Connect(t *testing.T) {
+	echoAddr := startEchoServer(t)
+
+	accessLog := &lockedBuffer{}
+	proxyAddr := startServer(t, &Config{
+		Credentials:     StaticCredentials{"foo": "bar"},
+		AccessLogWriter: accessLog,
+		Logger:          log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	conn, err := Dial("tcp", proxyAddr, echoAddr, &UsernamePassword{Username: "foo", Password: "bar"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+	conn.Close()
+
+	// The line is written once the request completes
+	deadline := time.Now().Add(time.Second)
+	for accessLog.String() == "" {
+		if time.Now().After(deadline) {
+			t.Fatalf("no access log")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(accessLog.String()), &entry); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, entry["timestamp"].(string)); err != nil {
+		t.Fatalf("bad timestamp: %v", entry)
+	}
+	if entry["client"] != conn.LocalAddr().String() ||
+		entry["user"] != "foo" ||
+		entry["version"] != float64(socks5Version) ||
+		entry["command"] != "connect" ||
+		entry["dest"] != echoAddr ||
+		entry["reply_code"] != float64(SuccessReply) {
+		t.Fatalf("bad: %v", entry)
+	}
+	// The reply and "ping" were sent, only "ping" was received
+	if entry["bytes_sent"] != float64(10+4) || entry["bytes_recv"] != float64(4) {
+		t.Fatalf("bad: %v", entry)
+	}
+	if _, ok := entry["duration_ms"].(float64); !ok {
+		t.Fatalf("bad: %v", entry)
+	}
+	if timings, ok := entry["timings_ms"].(map[string]interface{}); !ok || timings["dial"].(float64) <= 0 {
+		t.Fatalf("bad: %v", entry)
+	}
+	if _, ok := entry["error"]; ok {
+		t.Fatalf("bad: %v", entry)
+	}
+}
+
+func TestAccessLog_SOCKS4UserID(t *testing.T) {
+	echoAddr := startEchoServer(t)
+
+	for _, tc := range []struct {
+		log      bool
+		hash     func(string) string
+		expected interface{}
+	}{
+		{false, nil, nil},
+		{true, nil, "alice"},
+		{true, func(id string) string { return "hashed-" + id }, "hashed-alice"},
+	} {
+		accessLog := &lockedBuffer{}
+		proxyAddr := startServer(t, &Config{
+			AccessLogWriter: accessLog,
+			LogUserID:       tc.log,
+			HashUserID:      tc.hash,
+			Logger:          log.New(os.Stdout, "", log.LstdFlags),
+		})
+
+		conn, err := DialSOCKS4("tcp", proxyAddr, echoAddr, "alice")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		testEcho(t, conn)
+		conn.Close()
+
+		deadline := time.Now().Add(time.Second)
+		for accessLog.String() == "" {
+			if time.Now().After(deadline) {
+				t.Fatalf("no access log")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(accessLog.String()), &entry); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if entry["user"] != tc.expected ||
+			entry["version"] != float64(socks4Version) ||
+			entry["reply_code"] != float64(0x5a) {
+			t.Fatalf("bad: %v", entry)
+		}
+		if !tc.log && strings.Contains(accessLog.String(), "alice") {
+			t.Fatalf("userid leaked: %s", accessLog.String())
+		}
+	}
+}
+
+func TestAccessLog_InterceptMetadata(t *testing.T) {
+	accessLog := &lockedBuffer{}
+	var intercepted Request
+	proxyAddr := startServer(t, &Config{
+		Credentials:     StaticCredentials{"foo": "bar"},
+		AccessLogWriter: accessLog,
+		Resolver:        staticResolver(net.IPv4(10, 0, 0, 1)),
+		Logger:          log.New(os.Stdout, "", log.LstdFlags),
+		Intercept: func(req *Request) (bool, net.Conn, error) {
+			intercepted = *req
+			local, remote := net.Pipe()
+			go func() {
+				defer remote.Close()
+				buf := make([]byte, 4)
+				io.ReadFull(remote, buf)
+				remote.Write(buf)
+			}()
+			req.Metadata = map[string]string{"service": "echo"}
+			return true, local, nil
+		},
+	})
+
+	conn, err := Dial("tcp", proxyAddr, "service.local:80", &UsernamePassword{Username: "foo", Password: "bar"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+	conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for accessLog.String() == "" {
+		if time.Now().After(deadline) {
+			t.Fatalf("no access log")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The hook sees the parsed request with its auth context and client
+	if intercepted.AuthContext == nil || intercepted.AuthContext.Payload["Username"] != "foo" {
+		t.Fatalf("bad: %v", intercepted.AuthContext)
+	}
+	if intercepted.RemoteAddr == nil || intercepted.RemoteAddr.Address() != conn.LocalAddr().String() {
+		t.Fatalf("bad: %v", intercepted.RemoteAddr)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(accessLog.String()), &entry); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	metadata, ok := entry["metadata"].(map[string]interface{})
+	if !ok || metadata["service"] != "echo" || entry["dest"] != "service.local:80" {
+		t.Fatalf("bad: %v", entry)
+	}
+}
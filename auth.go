@@ -3,6 +3,7 @@ package socks
 import (
 	"fmt"
 	"io"
+	"net"
 )
 
 const (
@@ -28,6 +29,8 @@ type AuthContext struct {
 	// Keys depend on the used auth method.
 	// For UserPassauth contains Username
 	Payload map[string]string
+	// Methods offered by the client in its greeting, in order
+	OfferedMethods []uint8
 }
 
 type Authenticator interface {
@@ -44,7 +47,7 @@ func (a NoAuthAuthenticator) GetCode() uint8 {
 
 func (a NoAuthAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
 	_, err := writer.Write([]byte{socks5Version, NoAuth})
-	return &AuthContext{NoAuth, nil}, err
+	return &AuthContext{Method: NoAuth}, err
 }
 
 // UserPassAuthenticator is used to handle username/password based
@@ -63,6 +66,12 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 		return nil, err
 	}
 
+	return a.verify(reader, writer)
+}
+
+// verify runs the username/password sub-negotiation. It can be repeated
+// on the same connection after a failure
+func (a UserPassAuthenticator) verify(reader io.Reader, writer io.Writer) (*AuthContext, error) {
 	// Get the version and username length
 	header := []byte{0, 0}
 	if _, err := io.ReadAtLeast(reader, header, 2); err != nil {
@@ -82,7 +91,7 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 	}
 
 	// Get the password length
-	if _, err := reader.Read(header[:1]); err != nil {
+	if _, err := io.ReadFull(reader, header[:1]); err != nil {
 		return nil, err
 	}
 
@@ -106,27 +115,69 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 	}
 
 	// Done
-	return &AuthContext{UserPassAuth, map[string]string{"Username": string(user)}}, nil
+	return &AuthContext{Method: UserPassAuth, Payload: map[string]string{"Username": string(user)}}, nil
+}
+
+// retryableAuthenticator is implemented by authenticators able to
+// repeat their sub-negotiation after failed credentials
+type retryableAuthenticator interface {
+	verify(reader io.Reader, writer io.Writer) (*AuthContext, error)
 }
 
 // authenticate is used to handle connection authentication
 func (s *Server) authenticate(conn io.Writer, bufConn io.Reader) (*AuthContext, error) {
+	_, authContext, err := s.negotiateAuth(conn, bufConn, nil)
+	return authContext, err
+}
+
+// negotiateAuth is like authenticate, but also returns the method
+// that was selected during negotiation, even when authentication fails,
+// possibly a compressed variant (see compressedBase).
+// noAcceptable is returned if the client offered no usable method.
+// Failures are accounted to the client IP source, if known.
+func (s *Server) negotiateAuth(conn io.Writer, bufConn io.Reader, source net.IP) (uint8, *AuthContext, error) {
 	// Get the methods
 	methods, err := readMethods(bufConn)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get auth methods: %v", err)
+		return noAcceptable, nil, fmt.Errorf("failed to get auth methods: %v", err)
+	}
+
+	if s.config.FailureDelay > 0 {
+		conn = &authFailureWriter{Writer: conn, s: s}
 	}
 
 	// Select a usable method
 	for _, method := range methods {
-		cator, found := s.authMethods[method]
-		if found {
-			return cator.Authenticate(bufConn, conn)
+		base, compressed := s.compressedBase(method)
+		cator, found := s.authMethods[base]
+		if !found {
+			continue
+		}
+		if compressed {
+			conn = &methodWriter{Writer: conn, method: method}
+		}
+		// Failed credentials may be retried up to MaxAuthAttempts times
+		authContext, err := cator.Authenticate(bufConn, conn)
+		for attempt := 1; ; attempt++ {
+			if err != ErrUserAuthFailed {
+				if err == nil {
+					s.authSucceeded(source)
+					authContext.OfferedMethods = methods
+				}
+				return method, authContext, err
+			}
+			s.authFailed(source)
+			retry, ok := cator.(retryableAuthenticator)
+			if !ok || attempt >= s.config.MaxAuthAttempts || s.lockedOut(source) {
+				return method, nil, err
+			}
+			authContext, err = retry.verify(bufConn, conn)
 		}
 	}
 
 	// No usable method found
-	return nil, noAcceptableAuth(conn)
+	s.failureDelay()
+	return noAcceptable, nil, noAcceptableAuth(conn)
 }
 
 // noAcceptableAuth is used to handle when we have no eligible
@@ -140,12 +191,14 @@ func noAcceptableAuth(conn io.Writer) error {
 // and proceeding auth methods
 func readMethods(r io.Reader) ([]byte, error) {
 	header := []byte{0}
-	if _, err := r.Read(header); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read number of methods: %v", err)
 	}
 
 	numMethods := int(header[0])
 	methods := make([]byte, numMethods)
-	_, err := io.ReadAtLeast(r, methods, numMethods)
-	return methods, err
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, fmt.Errorf("failed to read %d methods: %v", numMethods, err)
+	}
+	return methods, nil
 }
@@ -2,7 +2,10 @@ package socks
 
 import (
 	"bytes"
+	"io"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestNoAuth(t *testing.T) {
@@ -117,3 +120,249 @@ func TestNoSupportedAuth(t *testing.T) {
 		t.Fatalf("bad: %v", out)
 	}
 }
+
+func TestRequireAuth(t *testing.T) {
+	cator := UserPassAuthenticator{Credentials: StaticCredentials{"foo": "bar"}}
+	s, err := New(&Config{
+		AuthMethods: []Authenticator{NoAuthAuthenticator{}, cator},
+		RequireAuth: true,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A no-auth-only client is rejected, even if NoAuth is listed
+	req := bytes.NewBuffer([]byte{1, NoAuth})
+	var resp bytes.Buffer
+	if _, err := s.authenticate(&resp, req); err != ErrNoSupportedAuth {
+		t.Fatalf("err: %v", err)
+	}
+	if out := resp.Bytes(); !bytes.Equal(out, []byte{socks5Version, noAcceptable}) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// SOCKS4 clients are rejected
+	proxyAddr := startServer(t, &Config{
+		Credentials: StaticCredentials{"foo": "bar"},
+		RequireAuth: true,
+	})
+	if _, err := DialSOCKS4("tcp", proxyAddr, "127.0.0.1:80", "foo"); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// There must be something to require
+	for _, conf := range []*Config{
+		{RequireAuth: true},
+		{RequireAuth: true, AuthMethods: []Authenticator{NoAuthAuthenticator{}}, Credentials: StaticCredentials{}},
+	} {
+		if err := conf.Validate(); err == nil {
+			t.Fatalf("expected error")
+		}
+	}
+}
+
+func TestAuth_OfferedMethods(t *testing.T) {
+	// The client offers GSSAPI along with the supported methods
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{3, 1, UserPassAuth, NoAuth})
+	var resp bytes.Buffer
+
+	s, _ := New(&Config{})
+	ctx, err := s.authenticate(&resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if ctx.Method != NoAuth {
+		t.Fatal("Invalid Context Method")
+	}
+	if !bytes.Equal(ctx.OfferedMethods, []byte{1, UserPassAuth, NoAuth}) {
+		t.Fatalf("bad: %v", ctx.OfferedMethods)
+	}
+}
+
+func TestPasswordAuth_MaxAuthAttempts(t *testing.T) {
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{1, UserPassAuth})
+	req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'z'})
+	req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	var resp bytes.Buffer
+
+	cator := UserPassAuthenticator{Credentials: StaticCredentials{"foo": "bar"}}
+	s, _ := New(&Config{AuthMethods: []Authenticator{cator}, MaxAuthAttempts: 2})
+
+	ctx, err := s.authenticate(&resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ctx.Payload["Username"] != "foo" {
+		t.Fatalf("bad: %v", ctx.Payload)
+	}
+
+	out := resp.Bytes()
+	if !bytes.Equal(out, []byte{socks5Version, UserPassAuth, 1, authFailure, 1, authSuccess}) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Third attempt is never read
+	req.Reset()
+	req.Write([]byte{1, UserPassAuth})
+	for i := 0; i < 3; i++ {
+		req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'z'})
+	}
+	resp.Reset()
+	if _, err := s.authenticate(&resp, req); err != ErrUserAuthFailed {
+		t.Fatalf("err: %v", err)
+	}
+	out = resp.Bytes()
+	if !bytes.Equal(out, []byte{socks5Version, UserPassAuth, 1, authFailure, 1, authFailure}) {
+		t.Fatalf("bad: %v", out)
+	}
+	if req.Len() != 9 {
+		t.Fatalf("bad: %d bytes left", req.Len())
+	}
+}
+
+func TestAuthLockout(t *testing.T) {
+	cator := UserPassAuthenticator{Credentials: StaticCredentials{"foo": "bar"}}
+	s, _ := New(&Config{
+		AuthMethods:     []Authenticator{cator},
+		MaxAuthAttempts: 5,
+		AuthLockout:     &AuthLockout{MaxFailures: 2, Duration: time.Minute},
+	})
+	clock := useFakeClock(s)
+	source := net.ParseIP("10.0.0.1")
+
+	attempt := func(pass string) error {
+		req := bytes.NewBuffer(nil)
+		req.Write([]byte{1, UserPassAuth})
+		for i := 0; i < 5; i++ {
+			req.Write([]byte{1, 3, 'f', 'o', 'o', byte(len(pass))})
+			req.WriteString(pass)
+		}
+		_, _, err := s.negotiateAuth(&bytes.Buffer{}, req, source)
+		return err
+	}
+
+	// The lockout ends the retries early
+	if err := attempt("baz"); err != ErrUserAuthFailed {
+		t.Fatalf("err: %v", err)
+	}
+	if !s.lockedOut(source) {
+		t.Fatalf("expected lockout")
+	}
+	if s.lockedOut(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("unexpected lockout")
+	}
+
+	clock.Advance(time.Minute)
+	if s.lockedOut(source) {
+		t.Fatalf("lockout did not expire")
+	}
+
+	// A success forgets previous failures
+	s.authFailed(source)
+	if err := attempt("bar"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s.authFailed(source)
+	if s.lockedOut(source) {
+		t.Fatalf("unexpected lockout")
+	}
+
+	// Failures too far apart don't add up
+	clock.Advance(time.Minute)
+	s.authFailed(source)
+	if s.lockedOut(source) {
+		t.Fatalf("unexpected lockout")
+	}
+}
+
+func TestAuthLockout_MaxClients(t *testing.T) {
+	s, _ := New(&Config{
+		AuthLockout: &AuthLockout{MaxFailures: 1, Duration: time.Minute, MaxClients: 2},
+	})
+	clock := useFakeClock(s)
+
+	s.authFailed(net.ParseIP("10.0.0.1"))
+	clock.Advance(time.Second)
+	s.authFailed(net.ParseIP("10.0.0.2"))
+	clock.Advance(time.Second)
+
+	// The lockout ending first is dropped
+	s.authFailed(net.ParseIP("10.0.0.3"))
+	if len(s.authFailures) != 2 {
+		t.Fatalf("bad: %d entries", len(s.authFailures))
+	}
+	if s.lockedOut(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("unexpected lockout")
+	}
+	if !s.lockedOut(net.ParseIP("10.0.0.2")) || !s.lockedOut(net.ParseIP("10.0.0.3")) {
+		t.Fatalf("expected lockout")
+	}
+
+	// Expired entries are dropped first
+	clock.Advance(time.Minute)
+	s.authFailed(net.ParseIP("10.0.0.4"))
+	if len(s.authFailures) != 1 {
+		t.Fatalf("bad: %d entries", len(s.authFailures))
+	}
+}
+
+func TestAuthLockout_MaxClients_KeepsLockouts(t *testing.T) {
+	s, _ := New(&Config{
+		AuthLockout: &AuthLockout{MaxFailures: 2, Duration: time.Minute, MaxClients: 2},
+	})
+	clock := useFakeClock(s)
+
+	// 10.0.0.1 is locked out, 10.0.0.2 only failed once, later
+	s.authFailed(net.ParseIP("10.0.0.1"))
+	s.authFailed(net.ParseIP("10.0.0.1"))
+	clock.Advance(time.Second)
+	s.authFailed(net.ParseIP("10.0.0.2"))
+	clock.Advance(time.Second)
+
+	// The lockout survives a new client
+	s.authFailed(net.ParseIP("10.0.0.3"))
+	if len(s.authFailures) != 2 {
+		t.Fatalf("bad: %d entries", len(s.authFailures))
+	}
+	if !s.lockedOut(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("expected lockout")
+	}
+	if _, ok := s.authFailures["10.0.0.2"]; ok {
+		t.Fatalf("expected 10.0.0.2 to be dropped")
+	}
+}
+
+func TestAuthLockout_ServeConn(t *testing.T) {
+	cator := UserPassAuthenticator{Credentials: StaticCredentials{"foo": "bar"}}
+	s, _ := New(&Config{
+		AuthMethods: []Authenticator{cator},
+		AuthLockout: &AuthLockout{MaxFailures: 1, Duration: time.Minute},
+	})
+	useFakeClock(s)
+	s.authFailed(net.ParseIP("127.0.0.1"))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go s.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{socks5Version, 1, UserPassAuth})
+
+	out, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, []byte{socks5Version, noAcceptable}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
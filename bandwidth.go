@@ -0,0 +1,100 @@
+package socks
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// maxBandwidthChunk bounds the reads paid for at once, so that relays
+// sharing a limiter take turns often
+const maxBandwidthChunk = 32 * 1024
+
+// bandwidthLimiter is a token bucket shared by relays. Every read pays
+// for its bytes by pushing back the time the bucket is next available,
+// and waits for the reads before it. As reads are bounded in size and
+// served in order, no relay can starve the others
+type bandwidthLimiter struct {
+	clock clock
+	rate  int64
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newBandwidthLimiter(c clock, rate int64) *bandwidthLimiter {
+	return &bandwidthLimiter{clock: c, rate: rate}
+}
+
+// chunk returns the largest read allowed: a tenth of a second of data
+func (l *bandwidthLimiter) chunk() int {
+	c := l.rate / 10
+	if c < 1 {
+		c = 1
+	}
+	if c > maxBandwidthChunk {
+		c = maxBandwidthChunk
+	}
+	return int(c)
+}
+
+// reserve accounts for n bytes, returning how long to wait before
+// passing them on
+func (l *bandwidthLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	return wait
+}
+
+// reader wraps r so that reading from it draws from the limiter. Waits
+// are cut short once done is closed
+func (l *bandwidthLimiter) reader(r io.Reader, done <-chan struct{}) io.Reader {
+	return &throttledReader{r: r, l: l, done: done}
+}
+
+type throttledReader struct {
+	r    io.Reader
+	l    *bandwidthLimiter
+	done <-chan struct{}
+}
+
+func (t *throttledReader) Read(b []byte) (int, error) {
+	if c := t.l.chunk(); len(b) > c {
+		b = b[:c]
+	}
+	n, err := t.r.Read(b)
+	if n > 0 {
+		if wait := t.l.reserve(n); wait > 0 {
+			timer := t.l.clock.NewTimer(wait)
+			select {
+			case <-timer.C():
+			case <-t.done:
+				timer.Stop()
+			}
+		}
+	}
+	return n, err
+}
+
+// bandwidthLimiters returns the limiters of the data sent by and to
+// clients, which are the same one unless Config.GlobalBandwidthPerDirection
+// is set. They are nil if there is no Config.GlobalBandwidthLimit
+func (s *Server) bandwidthLimiters() (up, down *bandwidthLimiter) {
+	s.bandwidthOnce.Do(func() {
+		if s.config.GlobalBandwidthLimit <= 0 {
+			return
+		}
+		s.bandwidthUp = newBandwidthLimiter(s.clk(), s.config.GlobalBandwidthLimit)
+		s.bandwidthDown = s.bandwidthUp
+		if s.config.GlobalBandwidthPerDirection {
+			s.bandwidthDown = newBandwidthLimiter(s.clk(), s.config.GlobalBandwidthLimit)
+		}
+	})
+	return s.bandwidthUp, s.bandwidthDown
+}
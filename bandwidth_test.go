@@ -0,0 +1,55 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServer_GlobalBandwidthLimit(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	proxyAddr := startServer(t, &Config{
+		GlobalBandwidthLimit: 200 * 1024,
+		Logger:               log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	// Two clients each echo 40KB: 160KB cross the proxy in total
+	payload := bytes.Repeat([]byte("x"), 40*1024)
+	start := time.Now()
+	finished := make([]time.Duration, 2)
+	var wg sync.WaitGroup
+	for i := range finished {
+		conn, err := Dial("tcp", proxyAddr, echoAddr, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			go conn.Write(payload)
+			out := make([]byte, len(payload))
+			if _, err := io.ReadFull(conn, out); err != nil {
+				t.Errorf("err: %v", err)
+			}
+			finished[i] = time.Since(start)
+		}(i)
+	}
+	wg.Wait()
+
+	// At 200KB/s, less the first chunk which is not waited for, this
+	// takes at least 0.7s
+	last := finished[0]
+	if finished[1] > last {
+		last = finished[1]
+	}
+	if last < 650*time.Millisecond || last > 5*time.Second {
+		t.Fatalf("bad: %v", finished)
+	}
+}
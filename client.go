@@ -0,0 +1,189 @@
+package socks
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// UsernamePassword are the credentials used by Dial for
+// username/password authentication
+type UsernamePassword struct {
+	Username string
+	Password string
+}
+
+// Dial connects to targetAddr through the SOCKS5 proxy at proxyAddr,
+// returning the tunneled connection. If auth is nil the "No Auth" mode
+// is used, username/password authentication otherwise
+func Dial(network, proxyAddr, targetAddr string, auth *UsernamePassword) (net.Conn, error) {
+	dest, err := parseDialAddr(targetAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial(network, proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := clientHandshakeV5(conn, dest, auth); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// DialSOCKS4 connects to targetAddr through the SOCKS4 proxy at
+// proxyAddr, returning the tunneled connection. If targetAddr is not
+// an IPv4 address, the hostname is sent to the proxy using SOCKS4a
+func DialSOCKS4(network, proxyAddr, targetAddr, userID string) (net.Conn, error) {
+	dest, err := parseDialAddr(targetAddr)
+	if err != nil {
+		return nil, err
+	}
+	if dest.IP != nil && dest.IP.To4() == nil {
+		return nil, fmt.Errorf("socks4 does not support address %v", dest.IP)
+	}
+
+	conn, err := net.Dial(network, proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := clientHandshakeV4(conn, dest, userID); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// parseDialAddr is used to convert a host:port string to an AddrSpec
+func parseDialAddr(addr string) (*AddrSpec, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, fmt.Errorf("invalid port: %v", portStr)
+	}
+	dest := &AddrSpec{Port: port}
+	if ip := net.ParseIP(host); ip != nil {
+		dest.IP = ip
+	} else {
+		dest.FQDN = host
+	}
+	return dest, nil
+}
+
+// clientHandshakeV5 is used to perform the client side of a SOCKS5
+// CONNECT to dest
+func clientHandshakeV5(conn io.ReadWriter, dest *AddrSpec, auth *UsernamePassword) error {
+	_, err := clientHandshakeV5Compress(conn, dest, auth, false)
+	return err
+}
+
+// clientHandshakeV5Compress is like clientHandshakeV5. If compress is
+// set it also offers the compressed variants of the methods, reporting
+// whether the server selected one
+func clientHandshakeV5Compress(conn io.ReadWriter, dest *AddrSpec, auth *UsernamePassword, compress bool) (bool, error) {
+	methods := []byte{NoAuth}
+	if auth != nil {
+		methods = append(methods, UserPassAuth)
+	}
+	if compress {
+		// Preferred over the plain methods
+		offered := make([]byte, 0, 2*len(methods))
+		for _, m := range methods {
+			offered = append(offered, m|compressedMethodFlag)
+		}
+		methods = append(offered, methods...)
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return false, err
+	}
+	method := []byte{0, 0}
+	if _, err := io.ReadFull(conn, method); err != nil {
+		return false, fmt.Errorf("failed to get auth method: %v", err)
+	}
+	compressed := false
+	if compress && method[1] != noAcceptable && method[1]&compressedMethodFlag != 0 {
+		compressed = true
+		method[1] &^= compressedMethodFlag
+	}
+
+	switch {
+	case method[1] == NoAuth:
+	case method[1] == UserPassAuth && auth != nil:
+		if len(auth.Username) > 255 || len(auth.Password) > 255 {
+			return false, fmt.Errorf("username or password too long")
+		}
+		msg := []byte{userAuthVersion, byte(len(auth.Username))}
+		msg = append(msg, auth.Username...)
+		msg = append(msg, byte(len(auth.Password)))
+		msg = append(msg, auth.Password...)
+		if _, err := conn.Write(msg); err != nil {
+			return false, err
+		}
+		status := []byte{0, 0}
+		if _, err := io.ReadFull(conn, status); err != nil {
+			return false, fmt.Errorf("failed to get auth status: %v", err)
+		}
+		if status[1] != authSuccess {
+			return false, ErrUserAuthFailed
+		}
+	default:
+		return false, ErrNoSupportedAuth
+	}
+
+	addr, err := encodeAddrSpecV5(dest)
+	if err != nil {
+		return false, err
+	}
+	req := append([]byte{socks5Version, ConnectCommand, 0}, addr...)
+	if _, err := conn.Write(req); err != nil {
+		return false, err
+	}
+
+	header := []byte{0, 0, 0}
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return false, fmt.Errorf("failed to get reply: %v", err)
+	}
+	if _, err := readAddrSpecV5(conn, nil); err != nil {
+		return false, fmt.Errorf("failed to get bind address: %v", err)
+	}
+	if header[1] != SuccessReply {
+		return false, &ReplyError{Code: header[1], Err: fmt.Errorf("connect to %v failed with reply %d", dest, header[1])}
+	}
+	return compressed, nil
+}
+
+// clientHandshakeV4 is used to perform the client side of a SOCKS4(a)
+// CONNECT to dest
+func clientHandshakeV4(conn io.ReadWriter, dest *AddrSpec, userID string) error {
+	ip := []byte{0, 0, 0, 1}
+	if dest.IP != nil {
+		ip = dest.IP.To4()
+	}
+	req := []byte{socks4Version, ConnectCommand, byte(dest.Port >> 8), byte(dest.Port)}
+	req = append(req, ip...)
+	req = append(req, userID...)
+	req = append(req, 0)
+	if dest.IP == nil {
+		req = append(req, dest.FQDN...)
+		req = append(req, 0)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("failed to get reply: %v", err)
+	}
+	if reply[1] != 0x5a {
+		return fmt.Errorf("connect to %v failed with reply %d", dest, reply[1])
+	}
+	return nil
+}
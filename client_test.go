@@ -0,0 +1,107 @@
+package socks
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// startEchoServer starts a tcp server echoing back what it gets
+func startEchoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// startServer starts a socks server with the given config
+func startServer(t *testing.T, conf *Config) string {
+	serv, err := New(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go serv.Serve(l)
+	return l.Addr().String()
+}
+
+func testEcho(t *testing.T, conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := make([]byte, 4)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "ping" {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestDial(t *testing.T) {
+	target := startEchoServer(t)
+	proxyAddr := startServer(t, &Config{
+		Credentials: StaticCredentials{"foo": "bar"},
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	conn, err := Dial("tcp", proxyAddr, target, &UsernamePassword{"foo", "bar"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+
+	if _, err := Dial("tcp", proxyAddr, target, &UsernamePassword{"foo", "baz"}); err != ErrUserAuthFailed {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := Dial("tcp", proxyAddr, target, nil); err != ErrNoSupportedAuth {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestDialSOCKS4(t *testing.T) {
+	target := startEchoServer(t)
+	proxyAddr := startServer(t, &Config{
+		Resolver: staticResolver(net.IPv4(127, 0, 0, 1)),
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	conn, err := DialSOCKS4("tcp", proxyAddr, target, "foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+
+	// SOCKS4a
+	_, port, _ := net.SplitHostPort(target)
+	conn, err = DialSOCKS4("tcp", proxyAddr, net.JoinHostPort("example.test", port), "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+}
@@ -0,0 +1,54 @@
+package socks
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// clock is the source of time used by the server timeouts, so that
+// they can be driven by a fake clock in tests. Socket deadlines are
+// enforced by the OS on the real time, so they are not computed from it
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) timer
+}
+
+// timer is the subset of *time.Timer used by the server
+type timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// realClock is the clock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTimer(d time.Duration) timer         { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+// clk returns the server clock, defaulting to the real one
+func (s *Server) clk() clock {
+	if s.clock == nil {
+		return realClock{}
+	}
+	return s.clock
+}
+
+type clockKey struct{}
+
+// clockFromContext returns the clock of the server handling the request
+// the context belongs to, so that rule sets share it
+func clockFromContext(ctx context.Context) clock {
+	if c, ok := ctx.Value(clockKey{}).(clock); ok {
+		return c
+	}
+	return realClock{}
+}
@@ -0,0 +1,178 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock which only moves when advanced
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock    *fakeClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+// useFakeClock swaps the server clock with a fake one
+func useFakeClock(s *Server) *fakeClock {
+	c := newFakeClock()
+	s.clock = c
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{c, c.now.Add(d), make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward, firing the expired timers
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.deadline.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- c.now
+	}
+	c.timers = pending
+}
+
+// BlockUntil waits until n timers are pending
+func (c *fakeClock) BlockUntil(n int) {
+	for {
+		c.mu.Lock()
+		pending := len(c.timers)
+		c.mu.Unlock()
+		if pending >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, p := range t.clock.timers {
+		if p == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func TestRequest_Connect_IdleTimeout(t *testing.T) {
+	// Create a local listener which never sends anything
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, _ := l.Accept()
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	// Make server
+	s := &Server{config: &Config{
+		Rules:       PermitAll(),
+		IdleTimeout: time.Minute,
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+	}}
+	clock := useFakeClock(s)
+
+	// Create the connect request
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1})
+	buf.Write([]byte{byte(lAddr.Port >> 8), byte(lAddr.Port)})
+
+	// The client never sends anything after the request
+	client, server := net.Pipe()
+	defer client.Close()
+	req, err := NewRequest(io.MultiReader(buf, server), socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.handleRequest(req, server) }()
+	go io.Copy(io.Discard, client)
+
+	// Not idle long enough yet
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute - time.Second)
+	select {
+	case err := <-errCh:
+		t.Fatalf("unexpected return: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case err := <-errCh:
+		if err == nil || !strings.Contains(err.Error(), "closed") {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("idle timeout not triggered")
+	}
+}
+
+func TestServeConn_DeadlinesIgnoreFakeClock(t *testing.T) {
+	s, err := New(&Config{
+		Rules:            PermitNone(),
+		HandshakeTimeout: time.Minute,
+		WriteTimeout:     time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	// The fake clock is decades behind: socket deadlines computed from
+	// it would have passed already
+	useFakeClock(s)
+
+	err = s.ServeConn(newPipeConn(t, []byte{5, 1, NoAuth, 5, 1, 0, 1, 127, 0, 0, 1, 0, 80}))
+	if err == nil || !strings.Contains(err.Error(), "blocked by rules") {
+		t.Fatalf("err: %v", err)
+	}
+}
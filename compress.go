@@ -0,0 +1,126 @@
+package socks
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+)
+
+// compressedMethodFlag marks the private authentication methods that
+// go-socks servers use to agree on Config.RelayCompression. A method
+// with the flag set stands for the method without it, followed by a
+// compressed relay
+const compressedMethodFlag = uint8(0x80)
+
+// Compression compresses the data relayed between two cooperating
+// servers, see Config.RelayCompression
+type Compression interface {
+	// NewReader returns a reader decompressing r
+	NewReader(r io.Reader) io.Reader
+	// NewWriter returns a writer compressing to w
+	NewWriter(w io.Writer) (CompressionWriter, error)
+}
+
+// CompressionWriter is a compressing writer. Flush must send all the
+// data written so far, and Close terminate the stream
+type CompressionWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// DeflateCompression is a Compression using DEFLATE (RFC 1951) at the
+// given level, flate.DefaultCompression if zero
+type DeflateCompression struct {
+	Level int
+}
+
+func (d DeflateCompression) NewReader(r io.Reader) io.Reader {
+	return flate.NewReader(r)
+}
+
+func (d DeflateCompression) NewWriter(w io.Writer) (CompressionWriter, error) {
+	level := d.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	return flate.NewWriter(w, level)
+}
+
+// compressedBase returns the authentication method a negotiated method
+// stands for, and whether it asks for a compressed relay. Methods are
+// only taken as compressed if the server does not know them already
+func (s *Server) compressedBase(method uint8) (uint8, bool) {
+	if s.config.RelayCompression == nil || method&compressedMethodFlag == 0 {
+		return method, false
+	}
+	if _, ok := s.authMethods[method]; ok {
+		return method, false
+	}
+	return method &^ compressedMethodFlag, true
+}
+
+// methodWriter replaces the method selected by an authenticator with
+// its compressed variant
+type methodWriter struct {
+	io.Writer
+	method  uint8
+	written bool
+}
+
+func (w *methodWriter) Write(b []byte) (int, error) {
+	if !w.written && len(b) >= 2 {
+		w.written = true
+		b = append([]byte{b[0], w.method}, b[2:]...)
+	}
+	return w.Writer.Write(b)
+}
+
+// compressedConn compresses what is written to a connection, and
+// decompresses what is read from r
+type compressedConn struct {
+	net.Conn
+	r io.Reader
+	w CompressionWriter
+}
+
+// newCompressedConn wraps conn, reading compressed data from r, which
+// defaults to conn
+func newCompressedConn(c Compression, conn net.Conn, r io.Reader) (*compressedConn, error) {
+	if r == nil {
+		r = conn
+	}
+	w, err := c.NewWriter(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &compressedConn{Conn: conn, r: c.NewReader(r), w: w}, nil
+}
+
+func (c *compressedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Write compresses b, flushing it right away as relays are interactive
+func (c *compressedConn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err == nil {
+		err = c.w.Flush()
+	}
+	return n, err
+}
+
+// CloseWrite ends the compressed stream, then half-closes the connection
+func (c *compressedConn) CloseWrite() error {
+	if err := c.w.Close(); err != nil {
+		return err
+	}
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// NetConn returns the wrapped connection
+func (c *compressedConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,84 @@
+package socks
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRelayCompression(t *testing.T) {
+	echoAddr := startEchoServer(t)
+
+	accessLog := &lockedBuffer{}
+	upstream := startServer(t, &Config{
+		Credentials:      StaticCredentials{"proxy": "secret"},
+		RelayCompression: DeflateCompression{},
+		AccessLogWriter:  accessLog,
+		Logger:           log.New(os.Stdout, "", log.LstdFlags),
+	})
+	proxyAddr := startServer(t, &Config{
+		UpstreamSOCKS5Proxy: "socks5://proxy:secret@" + upstream,
+		RelayCompression:    DeflateCompression{},
+		Logger:              log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	conn, err := Dial("tcp", proxyAddr, echoAddr, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	payload := bytes.Repeat([]byte("compressible "), 5000)
+	go conn.Write(payload)
+	out := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, payload) {
+		t.Fatalf("bad: data mismatch")
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for accessLog.String() == "" {
+		if time.Now().After(deadline) {
+			t.Fatalf("no access log")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Far fewer bytes crossed the link between the two servers
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(accessLog.String()), &entry); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	limit := float64(len(payload) / 10)
+	if entry["bytes_recv"].(float64) > limit || entry["bytes_sent"].(float64) > limit {
+		t.Fatalf("bad: %v", entry)
+	}
+
+	// Standard clients are not affected
+	conn, err = Dial("tcp", upstream, echoAddr, &UsernamePassword{Username: "proxy", Password: "secret"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+	conn.Close()
+
+	// Nor are upstream proxies without compression
+	plain := startServer(t, &Config{Logger: log.New(os.Stdout, "", log.LstdFlags)})
+	proxyAddr = startServer(t, &Config{
+		UpstreamSOCKS5Proxy: "socks5://" + plain,
+		RelayCompression:    DeflateCompression{},
+		Logger:              log.New(os.Stdout, "", log.LstdFlags),
+	})
+	conn, err = Dial("tcp", proxyAddr, echoAddr, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+	conn.Close()
+}
@@ -0,0 +1,43 @@
+package socks
+
+import (
+	"net"
+)
+
+// acquireIPSlot reserves a connection slot for the client IP of conn,
+// returning false if it already uses Config.MaxConnsPerIP connections.
+// Only IPs with connections open are tracked, so the map is bounded by
+// the number of connections
+func (s *Server) acquireIPSlot(conn net.Conn) (string, bool) {
+	if s.config.MaxConnsPerIP <= 0 {
+		return "", true
+	}
+	client, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return "", true
+	}
+	ip := client.IP.String()
+
+	s.ipConnsMu.Lock()
+	defer s.ipConnsMu.Unlock()
+	if s.ipConns == nil {
+		s.ipConns = make(map[string]int)
+	}
+	if s.ipConns[ip] >= s.config.MaxConnsPerIP {
+		return "", false
+	}
+	s.ipConns[ip]++
+	return ip, true
+}
+
+// releaseIPSlot frees a slot taken by acquireIPSlot
+func (s *Server) releaseIPSlot(ip string) {
+	if ip == "" {
+		return
+	}
+	s.ipConnsMu.Lock()
+	defer s.ipConnsMu.Unlock()
+	if s.ipConns[ip]--; s.ipConns[ip] <= 0 {
+		delete(s.ipConns, ip)
+	}
+}
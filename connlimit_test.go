@@ -0,0 +1,85 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// greet opens a connection to the proxy and negotiates no auth,
+// returning an error if the proxy closed it instead
+func greet(t *testing.T, proxyAddr string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte{5, 1, NoAuth})
+	out := make([]byte, 2)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !bytes.Equal(out, []byte{5, NoAuth}) {
+		t.Fatalf("bad: %v", out)
+	}
+	return conn, nil
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	proxyAddr := startServer(t, &Config{
+		MaxConnsPerIP: 2,
+		Logger:        log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := greet(t, proxyAddr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	// Over the limit
+	if _, err := greet(t, proxyAddr); err == nil {
+		t.Fatalf("expected connection refused")
+	}
+
+	// Closing a connection frees its slot
+	conns[0].Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn, err := greet(t, proxyAddr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slot not released: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxConnsPerIP_Cleanup(t *testing.T) {
+	s := &Server{config: &Config{MaxConnsPerIP: 1}}
+	conn := &MockConn{}
+
+	ip, ok := s.acquireIPSlot(conn)
+	if !ok {
+		t.Fatalf("expected slot")
+	}
+	if _, ok := s.acquireIPSlot(conn); ok {
+		t.Fatalf("unexpected slot")
+	}
+	s.releaseIPSlot(ip)
+	if len(s.ipConns) != 0 {
+		t.Fatalf("bad: %v", s.ipConns)
+	}
+}
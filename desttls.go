@@ -0,0 +1,41 @@
+package socks
+
+import (
+	"crypto/tls"
+	"net"
+
+	"golang.org/x/net/context"
+)
+
+// destTLS wraps the connection dialed for req in TLS if Config.DestTLS
+// asks for it, completing the handshake. The server name defaults to
+// the requested hostname, or IP. The handshake is bounded by
+// Config.DestTLSHandshakeTimeout.
+func (s *Server) destTLS(ctx context.Context, req *Request, target net.Conn) (net.Conn, error) {
+	if s.config.DestTLS == nil {
+		return target, nil
+	}
+	conf := s.config.DestTLS(req)
+	if conf == nil {
+		return target, nil
+	}
+	if conf.ServerName == "" {
+		conf = conf.Clone()
+		conf.ServerName = req.DestAddr.FQDN
+		if conf.ServerName == "" {
+			conf.ServerName = req.DestAddr.IP.String()
+		}
+	}
+	timeout := s.config.DestTLSHandshakeTimeout
+	if timeout == 0 {
+		timeout = defaultDestTLSHandshakeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	tlsConn := tls.Client(target, conf)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
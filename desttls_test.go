@@ -0,0 +1,161 @@
+package socks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// issueCert returns a certificate for template, signed by parent, or
+// self-signed if parent is nil
+func issueCert(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestRequest_Connect_DestTLS(t *testing.T) {
+	ca := issueCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	serverCert := issueCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "echo.test"},
+		DNSNames:    []string{"echo.test"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	clientCert := issueCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "proxy"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+
+	// TLS echo server requiring a client certificate
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	peers := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if err := tlsConn.Handshake(); err != nil {
+			peers <- err.Error()
+			return
+		}
+		peers <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		io.Copy(conn, conn)
+	}()
+
+	proxyAddr := startServer(t, &Config{
+		Resolver: staticResolver(net.IPv4(127, 0, 0, 1)),
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+		DestTLS: func(req *Request) *tls.Config {
+			return &tls.Config{
+				RootCAs:      pool,
+				Certificates: []tls.Certificate{clientCert},
+			}
+		},
+	})
+
+	// The client speaks plaintext, the proxy TLS, checked against the
+	// requested hostname
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	conn, err := Dial("tcp", proxyAddr, net.JoinHostPort("echo.test", port), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+
+	if peer := <-peers; peer != "proxy" {
+		t.Fatalf("bad: %v", peer)
+	}
+}
+
+func TestRequest_Connect_DestTLS_HandshakeTimeout(t *testing.T) {
+	// The destination accepts connections but never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	proxyAddr := startServer(t, &Config{
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+		DestTLS: func(req *Request) *tls.Config {
+			return &tls.Config{}
+		},
+		DestTLSHandshakeTimeout: 50 * time.Millisecond,
+	})
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	tAddr := l.Addr().(*net.TCPAddr)
+	req := []byte{5, 1, NoAuth, 5, ConnectCommand, 0, Ipv4Address, 127, 0, 0, 1, byte(tAddr.Port >> 8), byte(tAddr.Port)}
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[3] != HostUnreachable {
+		t.Fatalf("bad: %v", out)
+	}
+}
@@ -0,0 +1,77 @@
+package socks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DialContext connects to addr through the server without using a real
+// socket: the SOCKS5 CONNECT is performed over an in-memory pipe, served
+// by ServeConn. The returned net.Conn is the tunneled connection.
+// It can be used as http.Transport.DialContext. Only the "No Auth" mode
+// is supported.
+func (s *Server) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network: %v", network)
+	}
+
+	dest, err := parseDialAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	client, server := net.Pipe()
+	go func() {
+		if err := s.ServeConn(server); err != nil {
+			s.config.Logger.Printf("%s", err)
+		}
+	}()
+
+	// Honor the context during the handshake. The watcher tells whether
+	// it closed the pipe, so that a cancellation racing with a completed
+	// handshake never returns, nor leaks, a closed connection
+	if deadline, ok := ctx.Deadline(); ok {
+		client.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	cancelled := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+			cancelled <- true
+		case <-done:
+			cancelled <- false
+		}
+	}()
+
+	err = clientHandshakeV5(client, dest, nil)
+	close(done)
+	if <-cancelled {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	client.SetDeadline(time.Time{})
+
+	return client, nil
+}
+
+// isTransientDialError reports whether a failed dial is worth retrying:
+// the destination refused the connection or did not answer in time
+func isTransientDialError(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
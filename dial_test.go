@@ -0,0 +1,74 @@
+package socks
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestServer_DialContext(t *testing.T) {
+	// Create a local http server
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pong"))
+	}))
+	defer backend.Close()
+
+	// Create a socks server, without listening
+	serv, err := New(&Config{
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{DialContext: serv.DialContext},
+	}
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(body) != "pong" {
+		t.Fatalf("bad: %s", body)
+	}
+}
+
+func TestServer_DialContext_Cancel(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	serv, err := New(&Config{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Whenever the cancellation lands, the dial either fails with the
+	// context error or returns a usable connection
+	for i := 0; i < 50; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(time.Duration(i)*20*time.Microsecond, cancel)
+		conn, err := serv.DialContext(ctx, "tcp", echoAddr)
+		if err != nil {
+			if err != context.Canceled {
+				t.Fatalf("err: %v", err)
+			}
+			continue
+		}
+		if err := conn.SetDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		testEcho(t, conn)
+		conn.Close()
+		cancel()
+	}
+}
@@ -0,0 +1,16 @@
+package socks
+
+import (
+	"syscall"
+)
+
+const dscpSupported = true
+
+// setSocketTOS sets the traffic class of a socket, as IP_TOS or
+// IPV6_TCLASS depending on the network
+var setSocketTOS = func(fd uintptr, network string, tos int) error {
+	if network == "tcp6" || network == "udp6" {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+}
@@ -0,0 +1,101 @@
+package socks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// socketTOS reads IP_TOS from a TCP connection
+func socketTOS(t *testing.T, conn net.Conn) int {
+	raw, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var tos int
+	var tosErr error
+	raw.Control(func(fd uintptr) {
+		tos, tosErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+	})
+	if tosErr != nil {
+		t.Fatalf("err: %v", tosErr)
+	}
+	return tos
+}
+
+func TestRequest_Connect_DSCP(t *testing.T) {
+	// Create a local listener
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	// Make server
+	var tos int
+	s := &Server{config: &Config{
+		Rules: PermitAll(),
+		DSCP:  46,
+		OnDial: func(req *Request, target net.Conn) (net.Conn, error) {
+			tos = socketTOS(t, target)
+			return target, nil
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	// Create the connect request
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1})
+	binary.Write(buf, binary.BigEndian, uint16(lAddr.Port))
+
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.handleRequest(req, &MockConn{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if tos != 46<<2 {
+		t.Fatalf("bad: %v", tos)
+	}
+}
+
+func TestMarkInbound_DSCP(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	s := &Server{config: &Config{DSCP: 10}}
+	if err := s.markInbound(conn); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if tos := socketTOS(t, conn); tos != 10<<2 {
+		t.Fatalf("bad: %v", tos)
+	}
+}
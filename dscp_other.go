@@ -0,0 +1,15 @@
+//go:build !linux
+
+package socks
+
+import (
+	"fmt"
+)
+
+const dscpSupported = false
+
+// setSocketTOS sets the traffic class of a socket, as IP_TOS or
+// IPV6_TCLASS depending on the network
+var setSocketTOS = func(fd uintptr, network string, tos int) error {
+	return fmt.Errorf("DSCP marking is not supported on this platform")
+}
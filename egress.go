@@ -0,0 +1,94 @@
+package socks
+
+import (
+	"net"
+
+	"golang.org/x/net/context"
+)
+
+// destIP returns the IP the IP based checks see for req: its final IP
+// or, for a hostname the server did not resolve, the IP looked up with
+// Config.Resolver or DNSResolver for the checks alone. The hostname is
+// still what gets dialed, so upstream proxies resolve it themselves.
+// The lookup is done once per request, nil if it fails
+func (s *Server) destIP(ctx context.Context, req *Request) net.IP {
+	dest := req.realDestAddr
+	if dest == nil {
+		dest = req.DestAddr
+	}
+	if len(dest.IP) != 0 || dest.FQDN == "" {
+		return dest.IP
+	}
+	if !req.checkIPLooked {
+		req.checkIPLooked = true
+		resolver := s.config.Resolver
+		if resolver == nil {
+			resolver = DNSResolver{}
+		}
+		_, req.checkIP, _ = resolver.Resolve(ctx, dest.FQDN)
+	}
+	return req.checkIP
+}
+
+// egressAllowed checks ip against Config.EgressAllow. If the list is
+// set, destinations whose IP is not known are refused as well
+func (s *Server) egressAllowed(ip net.IP) bool {
+	if len(s.config.EgressAllow) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range s.config.EgressAllow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// privateBlocked checks ip against Config.BlockPrivateDestinations.
+// Destinations whose IP is not known are blocked as well
+func (s *Server) privateBlocked(ip net.IP) bool {
+	if !s.config.BlockPrivateDestinations {
+		return false
+	}
+	if ip == nil {
+		return true
+	}
+	for _, n := range s.config.PrivateDestinationsAllow {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()
+}
+
+// cloudMetadataIPs are the addresses of well-known cloud instance
+// metadata services: AWS, GCP, Azure and OpenStack (IPv4 and IPv6),
+// AWS ECS tasks, Alibaba Cloud and Oracle Cloud
+var cloudMetadataIPs = []net.IP{
+	net.ParseIP("169.254.169.254"),
+	net.ParseIP("fd00:ec2::254"),
+	net.ParseIP("169.254.170.2"),
+	net.ParseIP("100.100.100.200"),
+	net.ParseIP("192.0.0.192"),
+}
+
+// metadataBlocked checks ip against Config.BlockCloudMetadata.
+// Destinations whose IP is not known are blocked as well
+func (s *Server) metadataBlocked(ip net.IP) bool {
+	if !s.config.BlockCloudMetadata {
+		return false
+	}
+	if ip == nil {
+		return true
+	}
+	for _, m := range cloudMetadataIPs {
+		if m.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
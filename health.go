@@ -0,0 +1,49 @@
+package socks
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// readinessProbeTimeout bounds the resolution done by Ready
+var readinessProbeTimeout = 2 * time.Second
+
+// Healthy returns true if the server is accepting connections on at
+// least one listener, and is not shutting down
+func (s *Server) Healthy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.listeners) > 0 && !s.inShutdown
+}
+
+// Ready returns true if the server is Healthy and, if
+// Config.ReadinessProbeHost is set, the resolver can resolve it within
+// readinessProbeTimeout
+func (s *Server) Ready() bool {
+	if !s.Healthy() {
+		return false
+	}
+	if s.config.ReadinessProbeHost == "" {
+		return true
+	}
+	var resolver NameResolver = DNSResolver{}
+	if s.config.Resolver != nil {
+		resolver = s.config.Resolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), readinessProbeTimeout)
+	defer cancel()
+
+	// Resolvers may ignore the context, don't wait on them past it
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := resolver.Resolve(ctx, s.config.ReadinessProbeHost)
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		return err == nil
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,112 @@
+package socks
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// failingResolver fails every resolution
+type failingResolver struct{}
+
+func (failingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, fmt.Errorf("resolver is down")
+}
+
+// hangingResolver blocks until released, ignoring the context
+type hangingResolver chan struct{}
+
+func (r hangingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	<-r
+	return ctx, nil, fmt.Errorf("released")
+}
+
+func TestServer_HealthyReady(t *testing.T) {
+	serv, err := New(&Config{
+		Resolver:           staticResolver(net.IPv4(127, 0, 0, 1)),
+		ReadinessProbeHost: "example.com",
+		Logger:             log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if serv.Healthy() || serv.Ready() {
+		t.Fatalf("not serving yet")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.Serve(l)
+
+	deadline := time.Now().Add(time.Second)
+	for !serv.Healthy() {
+		if time.Now().After(deadline) {
+			t.Fatalf("not healthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !serv.Ready() {
+		t.Fatalf("not ready")
+	}
+
+	// A broken resolver makes the server healthy but not ready
+	serv.config.Resolver = failingResolver{}
+	if !serv.Healthy() || serv.Ready() {
+		t.Fatalf("bad: healthy %v ready %v", serv.Healthy(), serv.Ready())
+	}
+	serv.config.Resolver = staticResolver(net.IPv4(127, 0, 0, 1))
+
+	if err := serv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if serv.Healthy() || serv.Ready() {
+		t.Fatalf("still healthy after shutdown")
+	}
+}
+
+func TestServer_Ready_Timeout(t *testing.T) {
+	timeout := readinessProbeTimeout
+	readinessProbeTimeout = 50 * time.Millisecond
+	defer func() { readinessProbeTimeout = timeout }()
+
+	release := make(hangingResolver)
+	defer close(release)
+	serv, err := New(&Config{
+		Resolver:           release,
+		ReadinessProbeHost: "example.com",
+		Logger:             log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.Serve(l)
+	defer serv.Shutdown(context.Background())
+
+	deadline := time.Now().Add(time.Second)
+	for !serv.Healthy() {
+		if time.Now().After(deadline) {
+			t.Fatalf("not healthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A resolver ignoring the context does not hang readiness
+	start := time.Now()
+	if serv.Ready() {
+		t.Fatalf("expected not ready")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("bad: took %v", d)
+	}
+}
@@ -0,0 +1,86 @@
+package socks
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// idleWatcher closes a connection once no data has been read through
+// its readers for the given timeout
+type idleWatcher struct {
+	clock        clock
+	timeout      time.Duration
+	lastActivity int64
+	done         chan struct{}
+}
+
+// newIdleWatcher starts watching, closing c when idle
+func (s *Server) newIdleWatcher(timeout time.Duration, c io.Closer) *idleWatcher {
+	w := &idleWatcher{
+		clock:   s.clk(),
+		timeout: timeout,
+		done:    make(chan struct{}),
+	}
+	w.touch()
+	go w.watch(c)
+	return w
+}
+
+// touch records some activity. It is a no-op on a nil watcher
+func (w *idleWatcher) touch() {
+	if w == nil {
+		return
+	}
+	atomic.StoreInt64(&w.lastActivity, w.clock.Now().UnixNano())
+}
+
+func (w *idleWatcher) watch(c io.Closer) {
+	wait := w.timeout
+	for {
+		t := w.clock.NewTimer(wait)
+		select {
+		case <-t.C():
+		case <-w.done:
+			t.Stop()
+			return
+		}
+
+		idle := w.clock.Now().Sub(time.Unix(0, atomic.LoadInt64(&w.lastActivity)))
+		if idle >= w.timeout {
+			c.Close()
+			return
+		}
+		wait = w.timeout - idle
+	}
+}
+
+// stop stops watching
+func (w *idleWatcher) stop() {
+	close(w.done)
+}
+
+// reader wraps r so that reading from it counts as activity
+func (w *idleWatcher) reader(r io.Reader) io.Reader {
+	return &idleReader{r, w}
+}
+
+type idleReader struct {
+	r io.Reader
+	w *idleWatcher
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.w.touch()
+	}
+	return n, err
+}
+
+// closerFunc is an io.Closer backed by a function
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
@@ -0,0 +1,127 @@
+package socks
+
+import (
+	"net"
+	"time"
+)
+
+// AuthLockout is used to lock out client IPs after repeated failed
+// authentications: once a client fails MaxFailures times, with less
+// than Duration between failures, it can't authenticate for Duration.
+// At most MaxClients IPs, 10000 if zero, are tracked: past it, expired
+// entries are dropped, then the ones not locked out that failed the
+// longest ago, and only then the lockouts ending first
+type AuthLockout struct {
+	MaxFailures int
+	Duration    time.Duration
+	MaxClients  int
+}
+
+// defaultAuthLockoutClients is the number of client IPs tracked if
+// AuthLockout.MaxClients is not set
+const defaultAuthLockoutClients = 10000
+
+// authFailures tracks the failed authentications of a client IP
+type authFailures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+// lockedOut reports whether ip is currently locked out
+func (s *Server) lockedOut(ip net.IP) bool {
+	if s.config.AuthLockout == nil || ip == nil {
+		return false
+	}
+	s.lockoutMu.Lock()
+	defer s.lockoutMu.Unlock()
+	f, ok := s.authFailures[ip.String()]
+	if !ok {
+		return false
+	}
+	now := s.clk().Now()
+	if now.Before(f.until) {
+		return true
+	}
+	if now.Sub(f.last) >= s.config.AuthLockout.Duration {
+		delete(s.authFailures, ip.String())
+	}
+	return false
+}
+
+// authFailed records a failed authentication from ip, locking it out
+// once it failed too many times
+func (s *Server) authFailed(ip net.IP) {
+	if s.config.AuthLockout == nil || ip == nil {
+		return
+	}
+	s.lockoutMu.Lock()
+	defer s.lockoutMu.Unlock()
+	if s.authFailures == nil {
+		s.authFailures = make(map[string]*authFailures)
+	}
+	now := s.clk().Now()
+	f, ok := s.authFailures[ip.String()]
+	if !ok || now.Sub(f.last) >= s.config.AuthLockout.Duration {
+		if !ok {
+			s.makeLockoutRoomLocked(now)
+		}
+		f = &authFailures{}
+		s.authFailures[ip.String()] = f
+	}
+	f.count++
+	f.last = now
+	if f.count >= s.config.AuthLockout.MaxFailures {
+		f.count = 0
+		f.until = now.Add(s.config.AuthLockout.Duration)
+	}
+}
+
+// makeLockoutRoomLocked ensures another client IP can be tracked,
+// dropping expired entries, or else the client not locked out that
+// failed the longest ago, or else the one whose lockout ends first.
+// s.lockoutMu must be held
+func (s *Server) makeLockoutRoomLocked(now time.Time) {
+	max := s.config.AuthLockout.MaxClients
+	if max <= 0 {
+		max = defaultAuthLockoutClients
+	}
+	if len(s.authFailures) < max {
+		return
+	}
+
+	var oldest, soonest string
+	for ip, f := range s.authFailures {
+		if now.Before(f.until) {
+			if soonest == "" || f.until.Before(s.authFailures[soonest].until) {
+				soonest = ip
+			}
+			continue
+		}
+		if now.Sub(f.last) >= s.config.AuthLockout.Duration {
+			delete(s.authFailures, ip)
+			continue
+		}
+		if oldest == "" || f.last.Before(s.authFailures[oldest].last) {
+			oldest = ip
+		}
+	}
+	if len(s.authFailures) < max {
+		return
+	}
+	if oldest != "" {
+		delete(s.authFailures, oldest)
+	} else {
+		delete(s.authFailures, soonest)
+	}
+}
+
+// authSucceeded forgets the failures of ip
+func (s *Server) authSucceeded(ip net.IP) {
+	if s.config.AuthLockout == nil || ip == nil {
+		return
+	}
+	s.lockoutMu.Lock()
+	defer s.lockoutMu.Unlock()
+	delete(s.authFailures, ip.String())
+}
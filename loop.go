@@ -0,0 +1,54 @@
+package socks
+
+import (
+	"net"
+)
+
+// isSelfAddr reports whether dest points at the server itself, that is
+// at one of its listen addresses or at one of Config.BlockedSelfAddrs.
+// Listen addresses with an unspecified IP match any local address.
+// Callers pass the IP hostnames resolve to
+func (s *Server) isSelfAddr(dest *AddrSpec) bool {
+	if dest == nil || len(dest.IP) == 0 {
+		return false
+	}
+
+	for _, a := range s.config.BlockedSelfAddrs {
+		if a.Port == dest.Port && a.IP.Equal(dest.IP) {
+			return true
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for l := range s.listeners {
+		a, ok := l.Addr().(*net.TCPAddr)
+		if !ok || a.Port != dest.Port {
+			continue
+		}
+		if a.IP.Equal(dest.IP) {
+			return true
+		}
+		if (len(a.IP) == 0 || a.IP.IsUnspecified()) && isLocalIP(dest.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalIP reports whether ip belongs to this host
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
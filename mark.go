@@ -0,0 +1,62 @@
+package socks
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// socketControl returns the function used to set up the sockets opened
+// to reach destinations, or nil if there is nothing to set up
+func (s *Server) socketControl() func(network, address string, c syscall.RawConn) error {
+	mark := s.config.SocketMark
+	dscp := s.config.DSCP
+	if mark == 0 && dscp == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var setErr error
+		err := c.Control(func(fd uintptr) {
+			if mark != 0 {
+				setErr = setSocketMark(fd, mark)
+			}
+			if setErr == nil && dscp != 0 {
+				setErr = setSocketTOS(fd, network, dscp<<2)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return setErr
+	}
+}
+
+// markInbound applies Config.DSCP to an accepted client connection
+func (s *Server) markInbound(conn net.Conn) error {
+	if s.config.DSCP == 0 {
+		return nil
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	network := "tcp4"
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() == nil {
+		network = "tcp6"
+	}
+	var setErr error
+	err = raw.Control(func(fd uintptr) {
+		setErr = setSocketTOS(fd, network, s.config.DSCP<<2)
+	})
+	if err != nil {
+		return err
+	}
+	if setErr != nil {
+		return fmt.Errorf("failed to set DSCP: %v", setErr)
+	}
+	return nil
+}
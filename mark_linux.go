@@ -0,0 +1,12 @@
+package socks
+
+import (
+	"syscall"
+)
+
+const socketMarkSupported = true
+
+// setSocketMark sets SO_MARK on a socket
+var setSocketMark = func(fd uintptr, mark int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+}
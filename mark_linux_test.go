@@ -0,0 +1,60 @@
+package socks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestRequest_Connect_SocketMark(t *testing.T) {
+	// Record the marks instead of setting them, which needs privileges
+	var marks []int
+	orig := setSocketMark
+	setSocketMark = func(fd uintptr, mark int) error {
+		marks = append(marks, mark)
+		return nil
+	}
+	defer func() { setSocketMark = orig }()
+
+	// Create a local listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	// Make server
+	s := &Server{config: &Config{
+		Rules:      PermitAll(),
+		SocketMark: 42,
+		Logger:     log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	// Create the connect request
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1})
+	binary.Write(buf, binary.BigEndian, uint16(lAddr.Port))
+
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.handleRequest(req, &MockConn{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if len(marks) != 1 || marks[0] != 42 {
+		t.Fatalf("bad: %v", marks)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package socks
+
+import (
+	"fmt"
+)
+
+const socketMarkSupported = false
+
+// setSocketMark sets SO_MARK on a socket
+var setSocketMark = func(fd uintptr, mark int) error {
+	return fmt.Errorf("socket mark is not supported on this platform")
+}
@@ -0,0 +1,23 @@
+package socks
+
+import (
+	"net"
+
+	"golang.org/x/net/context"
+)
+
+// Handler is used to handle a request once the client is authenticated.
+// It is responsible for replying to the client.
+type Handler func(ctx context.Context, conn net.Conn, req *Request) error
+
+// Middleware is used to wrap a Handler, e.g. for logging or metrics
+type Middleware func(next Handler) Handler
+
+// chainMiddlewares wraps h with the middlewares, the first one
+// being the outermost
+func chainMiddlewares(middlewares []Middleware, h Handler) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
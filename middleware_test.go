@@ -0,0 +1,98 @@
+package socks
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestMiddlewares_Order(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, conn net.Conn, req *Request) error {
+				calls = append(calls, name+" in")
+				err := next(ctx, conn, req)
+				calls = append(calls, name+" out")
+				return err
+			}
+		}
+	}
+
+	s := &Server{config: &Config{
+		Rules:       PermitNone(),
+		Middlewares: []Middleware{trace("first"), trace("second")},
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := &MockConn{}
+	if err := s.handleRequest(req, resp); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	expected := []string{"first in", "second in", "second out", "first out"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("bad: %v", calls)
+	}
+
+	// The core handler did reply
+	out := resp.buf.Bytes()
+	if !bytes.Equal(out, []byte{5, RuleFailure, 0, 1, 0, 0, 0, 0, 0, 0}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestMiddlewares_ShortCircuit(t *testing.T) {
+	var reached bool
+	deny := func(next Handler) Handler {
+		return func(ctx context.Context, conn net.Conn, req *Request) error {
+			if err := SendReply(ctx, conn, RuleFailure, nil, req.Version); err != nil {
+				return err
+			}
+			return fmt.Errorf("denied by middleware")
+		}
+	}
+	inner := func(next Handler) Handler {
+		return func(ctx context.Context, conn net.Conn, req *Request) error {
+			reached = true
+			return next(ctx, conn, req)
+		}
+	}
+
+	s := &Server{config: &Config{
+		Rules:       PermitAll(),
+		Middlewares: []Middleware{deny, inner},
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := &MockConn{}
+	if err := s.handleRequest(req, resp); err == nil || err.Error() != "denied by middleware" {
+		t.Fatalf("err: %v", err)
+	}
+	if reached {
+		t.Fatalf("inner middleware should not be reached")
+	}
+
+	out := resp.buf.Bytes()
+	if !bytes.Equal(out, []byte{5, RuleFailure, 0, 1, 0, 0, 0, 0, 0, 0}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
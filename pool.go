@@ -0,0 +1,23 @@
+package socks
+
+import (
+	"net"
+)
+
+// ConnPool is used to keep warm connections to frequently used
+// destinations, keyed by "host:port" address.
+//
+// Get is consulted by CONNECT before dialing. As SOCKS relays are
+// exclusive, a connection that was relayed on is consumed and closed,
+// never handed back. Every other connection the server got from Get or
+// dialed, and wrote nothing to, is handed to Put once the request ends,
+// such as when a later check refused it or the client went away before
+// the reply. Connections wrapped by OnDial or DestTLS, or intercepted,
+// are never pooled. Pooling thus only helps workloads reconnecting
+// quickly, with the pool itself warming connections up, e.g. by
+// dialing ahead. The pool must not hand out connections the remote end
+// may have closed.
+type ConnPool interface {
+	Get(addr string) (net.Conn, bool)
+	Put(addr string, conn net.Conn)
+}
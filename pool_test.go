@@ -0,0 +1,149 @@
+package socks
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// mockPool hands out the connections put in it
+type mockPool struct {
+	mu    sync.Mutex
+	conns map[string][]net.Conn
+	gets  int
+}
+
+func (p *mockPool) Get(addr string) (net.Conn, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gets++
+	conns := p.conns[addr]
+	if len(conns) == 0 {
+		return nil, false
+	}
+	p.conns[addr] = conns[1:]
+	return conns[0], true
+}
+
+func (p *mockPool) Put(addr string, conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns == nil {
+		p.conns = make(map[string][]net.Conn)
+	}
+	p.conns[addr] = append(p.conns[addr], conn)
+}
+
+func TestRequest_Connect_ConnPool(t *testing.T) {
+	local, remote := net.Pipe()
+	go func() {
+		defer remote.Close()
+		remote.Write([]byte("pong"))
+	}()
+	pool := &mockPool{}
+	pool.Put("10.0.0.1:80", local)
+
+	s := &Server{config: &Config{
+		Rules:    PermitAll(),
+		ConnPool: pool,
+		Dial: func(ctx context.Context, net_, addr string) (net.Conn, error) {
+			t.Fatalf("unexpected dial to %v", addr)
+			return nil, nil
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	buf := bytes.NewBuffer([]byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 80})
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := &MockConn{}
+	if err := s.handleRequest(req, resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out := resp.buf.Bytes()
+	if !bytes.Equal(out, []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0, 'p', 'o', 'n', 'g'}) {
+		t.Fatalf("bad: %v", out)
+	}
+	if pool.gets != 1 || len(pool.conns["10.0.0.1:80"]) != 0 {
+		t.Fatalf("bad: %v", pool.conns)
+	}
+}
+
+func TestRequest_Connect_ConnPool_Unused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	pool := &mockPool{}
+	s := &Server{config: &Config{
+		Rules:    PermitAll(),
+		ConnPool: pool,
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	lAddr := l.Addr().(*net.TCPAddr)
+	buf := bytes.NewBuffer([]byte{5, 1, 0, 1, 127, 0, 0, 1, byte(lAddr.Port >> 8), byte(lAddr.Port)})
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The client is gone before the reply, the dialed conn is pooled
+	if err := s.handleRequest(req, &closedConn{}); err == nil {
+		t.Fatalf("expected error")
+	}
+	conns := pool.conns[lAddr.String()]
+	if len(conns) != 1 {
+		t.Fatalf("bad: %v", pool.conns)
+	}
+	conns[0].Close()
+}
+
+func TestRequest_Connect_ConnPool_PutBack(t *testing.T) {
+	for _, onDial := range []bool{false, true} {
+		local, remote := net.Pipe()
+		defer remote.Close()
+		pool := &mockPool{}
+		pool.Put("10.0.0.1:80", local)
+
+		s := &Server{config: &Config{
+			Rules:    PermitAll(),
+			ConnPool: pool,
+			Logger:   log.New(os.Stdout, "", log.LstdFlags),
+		}}
+		if onDial {
+			s.config.OnDial = func(req *Request, conn net.Conn) (net.Conn, error) {
+				return conn, nil
+			}
+		}
+
+		buf := bytes.NewBuffer([]byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 80})
+		req, err := NewRequest(buf, socks5Version)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// A pooled conn the client never used goes back, unless a
+		// hook may have written to it
+		if err := s.handleRequest(req, &closedConn{}); err == nil {
+			t.Fatalf("expected error")
+		}
+		conns := pool.conns["10.0.0.1:80"]
+		if onDial && len(conns) != 0 {
+			t.Fatalf("bad: %v", conns)
+		}
+		if !onDial && (len(conns) != 1 || conns[0] != local) {
+			t.Fatalf("bad: %v", conns)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package socks
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// relay is used to shuffle data between the client and target, reading
+// client data from src and target data from dst. It returns once both
+// directions are done, or as soon as one fails or ctx is cancelled: in
+// that case both connections are closed, which unblocks pending reads,
+// so that no copy outlives the relay. Relays lasting longer than
+// Config.MaxConnDuration are closed the same way. Both directions draw
+// from the global bandwidth limiters, if any.
+func (s *Server) relay(ctx context.Context, conn conn, target net.Conn, src, dst io.Reader) (err error) {
+	ctx, span := s.startSpan(ctx, SpanRelay)
+	span.SetAttribute("socks.dest", target.RemoteAddr().String())
+	defer func() { span.End(err) }()
+
+	stopped := make(chan struct{})
+	if up, down := s.bandwidthLimiters(); up != nil {
+		src = up.reader(src, stopped)
+		dst = down.reader(dst, stopped)
+	}
+
+	errCh := make(chan error, 2)
+	go proxy(target, src, errCh)
+	go proxy(conn, dst, errCh)
+
+	var stopOnce sync.Once
+	stop := func() {
+		stopOnce.Do(func() {
+			close(stopped)
+			target.Close()
+			if c, ok := conn.(io.Closer); ok {
+				c.Close()
+			}
+		})
+	}
+
+	var expired <-chan time.Time
+	if s.config.MaxConnDuration > 0 {
+		t := s.clk().NewTimer(s.config.MaxConnDuration)
+		defer t.Stop()
+		expired = t.C()
+	}
+
+	done := ctx.Done()
+	for n := 0; n < 2; {
+		select {
+		case e := <-errCh:
+			n++
+			if e != nil && err == nil {
+				err = e
+				stop()
+			}
+		case <-done:
+			done = nil
+			if err == nil {
+				err = ctx.Err()
+			}
+			stop()
+		case <-expired:
+			expired = nil
+			if err == nil {
+				err = fmt.Errorf("relay to %v exceeded max duration of %v", target.RemoteAddr(), s.config.MaxConnDuration)
+				connID, _ := ConnIDFromContext(ctx)
+				s.config.Logger.Printf("[INFO] socks: conn %d: closing relay to %v: max duration of %v reached", connID, target.RemoteAddr(), s.config.MaxConnDuration)
+			}
+			stop()
+		}
+	}
+	return err
+}
+
+// baseContext returns the context requests are handled in. It is
+// cancelled when Shutdown gives up waiting for the connections
+func (s *Server) baseContext() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.baseCtx == nil {
+		s.baseCtx, s.cancelBase = context.WithCancel(context.Background())
+	}
+	return s.baseCtx
+}
@@ -0,0 +1,103 @@
+package socks
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestServer_Relay_Cancel(t *testing.T) {
+	s := &Server{config: &Config{
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	remote, target := net.Pipe()
+	defer remote.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.relay(ctx, conn, target, conn, target) }()
+
+	// Some data flows, then both sides go quiet with reads pending
+	go client.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	remote.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(remote, buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("relay did not stop")
+	}
+
+	// Both connections were closed
+	client.SetDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(buf); err != io.EOF {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := remote.Read(buf); err != io.EOF {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestServer_Relay_MaxConnDuration(t *testing.T) {
+	s := &Server{config: &Config{
+		MaxConnDuration: time.Hour,
+		Logger:          log.New(os.Stdout, "", log.LstdFlags),
+	}}
+	clock := useFakeClock(s)
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	remote, target := net.Pipe()
+	defer remote.Close()
+	go io.Copy(remote, remote)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.relay(context.Background(), conn, target, conn, target) }()
+	clock.BlockUntil(1)
+
+	// Activity does not extend the relay
+	client.SetDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 2; i++ {
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(client, buf); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		clock.Advance(30*time.Minute - time.Second)
+	}
+	select {
+	case err := <-errCh:
+		t.Fatalf("relay closed early: %v", err)
+	default:
+	}
+
+	clock.Advance(2 * time.Second)
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("relay not closed")
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected client conn closed")
+	}
+}
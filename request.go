@@ -1,6 +1,9 @@
 package socks
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -18,24 +21,82 @@ const (
 	Ipv4Address      = uint8(1)
 	FqdnAddress      = uint8(3)
 	Ipv6Address      = uint8(4)
+
+	// Tor extensions, see Config.EnableResolveExtension
+	ResolveCommand    = uint8(0xf0)
+	ResolvePTRCommand = uint8(0xf1)
 )
 
+// Reply codes, as defined by RFC 1928
+const (
+	SuccessReply uint8 = iota
+	ServerFailure
+	RuleFailure
+	NetworkUnreachable
+	HostUnreachable
+	ConnectionRefused
+	TtlExpired
+	CommandNotSupported
+	AddrTypeNotSupported
+)
+
+var replyCodeNames = []string{
+	SuccessReply:         "succeeded",
+	ServerFailure:        "general SOCKS server failure",
+	RuleFailure:          "connection not allowed by ruleset",
+	NetworkUnreachable:   "network unreachable",
+	HostUnreachable:      "host unreachable",
+	ConnectionRefused:    "connection refused",
+	TtlExpired:           "TTL expired",
+	CommandNotSupported:  "command not supported",
+	AddrTypeNotSupported: "address type not supported",
+}
+
+// ReplyCodeString returns the RFC 1928 description of a reply code
+func ReplyCodeString(code uint8) string {
+	if int(code) < len(replyCodeNames) {
+		return replyCodeNames[code]
+	}
+	return fmt.Sprintf("unassigned reply code %d", code)
+}
+
 const (
-	successReply uint8 = iota
-	serverFailure
-	ruleFailure
-	networkUnreachable
-	hostUnreachable
-	connectionRefused
-	ttlExpired
-	commandNotSupported
-	addrTypeNotSupported
+	// maxSocks4FieldLen is the longest SOCKS4 userid or SOCKS4a
+	// hostname accepted
+	maxSocks4FieldLen = 255
+
+	// defaultBindTimeout is how long a bind waits for the peer
+	// if Config.BindTimeout is not set
+	defaultBindTimeout = 2 * time.Minute
+
+	// defaultDestTLSHandshakeTimeout bounds the TLS handshake with the
+	// destination if Config.DestTLSHandshakeTimeout is not set
+	defaultDestTLSHandshakeTimeout = 10 * time.Second
 )
 
 var (
 	ErrUnrecognizedAddrType = fmt.Errorf("unrecognized address type")
+	ErrUnsupportedVersion   = fmt.Errorf("unsupported socks version")
+	ErrUnsupportedCommand   = fmt.Errorf("unsupported command")
+	ErrNonZeroRSV           = fmt.Errorf("non-zero reserved byte")
 )
 
+// ReplyError is returned when a request is refused, with the reply code
+// sent to the client. For SOCKS4 clients the code is the SOCKS5 one,
+// before translation.
+type ReplyError struct {
+	Code uint8
+	Err  error
+}
+
+func (e *ReplyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ReplyError) Unwrap() error {
+	return e.Err
+}
+
 // AddressRewriter is used to rewrite a destination transparently
 type AddressRewriter interface {
 	Rewrite(ctx context.Context, request *Request) (context.Context, *AddrSpec)
@@ -47,6 +108,9 @@ type AddrSpec struct {
 	FQDN string
 	IP   net.IP
 	Port int
+	// Zone is the IPv6 scope of IP, used only when dialing. It is
+	// never sent over the wire.
+	Zone string
 }
 
 func (a *AddrSpec) String() string {
@@ -60,11 +124,35 @@ func (a *AddrSpec) String() string {
 // address, fallback to FQDN
 func (a AddrSpec) Address() string {
 	if len(a.IP) != 0 {
-		return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
+		host := a.IP.String()
+		if a.Zone != "" && a.IP.To4() == nil {
+			host += "%" + a.Zone
+		}
+		return net.JoinHostPort(host, strconv.Itoa(a.Port))
 	}
 	return net.JoinHostPort(a.FQDN, strconv.Itoa(a.Port))
 }
 
+// MarshalBinary encodes the address in the SOCKS5 wire format: an
+// address type byte, followed by the address and port
+func (a *AddrSpec) MarshalBinary() ([]byte, error) {
+	return encodeAddrSpecV5(a)
+}
+
+// UnmarshalBinary decodes an address encoded by MarshalBinary
+func (a *AddrSpec) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	d, err := readAddrSpecV5(r, nil)
+	if err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("trailing data after address: %d bytes", r.Len())
+	}
+	*a = *d
+	return nil
+}
+
 // A Request represents request received by a server
 type Request struct {
 	// Protocol version
@@ -73,14 +161,63 @@ type Request struct {
 	Command uint8
 	// AuthContext provided during negotiation
 	AuthContext *AuthContext
+	// ID of the client connection, unique within the server, to
+	// correlate logs and hooks
+	ConnID uint64
 	// AddrSpec of the the network that sent the request
 	RemoteAddr *AddrSpec
 	// AddrSpec of the desired destination
 	DestAddr *AddrSpec
+	// Resolved is true if the server resolved the FQDN of DestAddr,
+	// which it only does with a Config.Resolver, rather than the client
+	// sending an IP. ResolvedIP is the address it resolved to, telling
+	// which family was used
+	Resolved   bool
+	ResolvedIP net.IP
 	// AddrSpec of the actual destination (might be affected by rewrite)
 	realDestAddr *AddrSpec
+	// Local and remote address of the connection to the destination,
+	// set once it is established
+	EgressLocalAddr  net.Addr
+	EgressRemoteAddr net.Addr
+	// Duration is the time taken by the whole connection, set once the
+	// request completes, and Timings that of its setup phases
+	Duration time.Duration
+	Timings  RequestTimings
+	// Metadata holds optional values attached by hooks, such as
+	// Intercept, which are reported in the access log
+	Metadata map[string]string
 
 	bufConn io.Reader
+	// compressed is set if the client negotiated a compressed relay
+	compressed bool
+	// checkIP is the IP looked up for the IP based checks of a
+	// hostname the server did not resolve, once checkIPLooked is set
+	checkIP       net.IP
+	checkIPLooked bool
+}
+
+// RequestTimings are the durations of the phases of a request, zero for
+// the phases it did not go through. They are measured on the monotonic
+// clock
+type RequestTimings struct {
+	// Greeting is the time until the client sent its version
+	Greeting time.Duration
+	// Auth is the time the SOCKS5 method negotiation and
+	// authentication took
+	Auth time.Duration
+	// Resolve is the time taken to resolve the destination FQDN
+	Resolve time.Duration
+	// Dial is the time taken to connect to the destination, retries
+	// included
+	Dial time.Duration
+}
+
+// Reader returns the reader client data should be read from. It may
+// hold data the client sent along with the request, so it must be
+// used in place of the connection
+func (r *Request) Reader() io.Reader {
+	return r.bufConn
 }
 
 type conn interface {
@@ -90,26 +227,41 @@ type conn interface {
 
 // NewRequest creates a new Request from the tcp connection
 func NewRequest(bufConn io.Reader, reqVersion byte) (*Request, error) {
+	return newRequest(bufConn, reqVersion, nil)
+}
+
+// newRequest is like NewRequest, also honouring the parsing options of
+// config, which may be nil
+func newRequest(bufConn io.Reader, reqVersion byte, config *Config) (*Request, error) {
+	var customAddrTypes map[uint8]func(io.Reader) (*AddrSpec, error)
+	strictRSV := false
+	if config != nil {
+		customAddrTypes = config.CustomAddrTypes
+		strictRSV = config.StrictRSV
+	}
 	request := &Request{
 		Version: reqVersion,
 		bufConn: bufConn,
 	}
 	switch reqVersion {
 	case socks5Version:
-		// Read the version byte
+		// Read VER, CMD and RSV. ATYP is read along with the address
 		header := []byte{0, 0, 0}
-		if _, err := io.ReadAtLeast(bufConn, header, 3); err != nil {
-			return nil, fmt.Errorf("failed to get command version: %v", err)
+		if _, err := io.ReadFull(bufConn, header); err != nil {
+			return nil, fmt.Errorf("failed to get command version: %w", err)
 		}
 
 		// Ensure we are compatible
 		if header[0] != socks5Version {
-			return nil, fmt.Errorf("unsupported command version: %v", header[0])
+			return nil, fmt.Errorf("%w in request: %v", ErrUnsupportedVersion, header[0])
+		}
+		if strictRSV && header[2] != 0 {
+			return nil, fmt.Errorf("%w in request: %v", ErrNonZeroRSV, header[2])
 		}
 		request.Command = header[1]
 		var err error
 		// Read in the destination address
-		request.DestAddr, err = readAddrSpecV5(bufConn)
+		request.DestAddr, err = readAddrSpecV5(bufConn, customAddrTypes)
 		if err != nil {
 			return nil, err
 		}
@@ -117,13 +269,11 @@ func NewRequest(bufConn io.Reader, reqVersion byte) (*Request, error) {
 		header := []byte{0}
 		// Read the command byte
 		if _, err := io.ReadAtLeast(bufConn, header, 1); err != nil {
-			return nil, fmt.Errorf("failed to get command: %v", err)
+			return nil, fmt.Errorf("failed to get command: %w", err)
 		}
 
-		// Ensure we are compatible
-		if header[0] != 1 {
-			return nil, fmt.Errorf("unsupported command: %v", header[0])
-		}
+		// Unsupported commands are rejected by handleRequest, once
+		// the whole request has been read
 		request.Command = header[0]
 
 		var err error
@@ -133,26 +283,35 @@ func NewRequest(bufConn io.Reader, reqVersion byte) (*Request, error) {
 			return nil, err
 		}
 
+		// SOCKS4a uses the 0.0.0.x address, with x non zero, to
+		// announce that a hostname follows the userid
 		addr := request.DestAddr.IP
 		isSocks4a := (addr[0] == 0 && addr[1] == 0 && addr[2] == 0 && addr[3] != 0)
 
-		username, err := readUntilNull(bufConn)
+		username, err := readUntilNull(bufConn, maxSocks4FieldLen)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("failed to get userid: %w", err)
 		}
 		if username != "" {
-			request.AuthContext = &AuthContext{UserPassAuth, map[string]string{"Username": username}}
+			request.AuthContext = &AuthContext{Method: UserPassAuth, Payload: map[string]string{"Username": username}}
 		}
 
 		if isSocks4a {
-			hostname, err := readUntilNull(bufConn)
+			hostname, err := readUntilNull(bufConn, maxSocks4FieldLen)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("failed to get socks4a hostname: %w", err)
+			}
+			if hostname == "" {
+				return nil, fmt.Errorf("missing socks4a hostname")
+			}
+			if !validFQDN(hostname) {
+				return nil, fmt.Errorf("invalid socks4a hostname %q", hostname)
 			}
 			request.DestAddr.FQDN = hostname
+			request.DestAddr.IP = nil
 		}
 	default:
-		return nil, fmt.Errorf("unsupported socks version: %d", reqVersion)
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, reqVersion)
 	}
 
 	return request, nil
@@ -160,20 +319,64 @@ func NewRequest(bufConn io.Reader, reqVersion byte) (*Request, error) {
 
 // handleRequest is used for request processing after authentication
 func (s *Server) handleRequest(req *Request, conn net.Conn) error {
-	ctx := context.Background()
+	ctx := context.WithValue(s.baseContext(), serverKey{}, s)
+	if s.clock != nil {
+		ctx = context.WithValue(ctx, clockKey{}, s.clock)
+	}
+	if req.ConnID != 0 {
+		ctx = context.WithValue(ctx, connIDKey{}, req.ConnID)
+	}
+	if req.RemoteAddr != nil {
+		ctx = context.WithValue(ctx, remoteAddrKey{}, req.RemoteAddr)
+	}
+	ctx, span := s.startSpan(ctx, SpanRequest)
+	span.SetAttribute("socks.command", req.Command)
+	span.SetAttribute("socks.dest", req.DestAddr.Address())
+	err := chainMiddlewares(s.config.Middlewares, s.serveRequest)(ctx, conn, req)
+	span.SetAttribute("socks.reply_code", replyCode(err))
+	span.End(err)
+	return err
+}
+
+// serveRequest is the core request handler, wrapped by the middlewares
+func (s *Server) serveRequest(ctx context.Context, conn net.Conn, req *Request) error {
+	// Reject globally disabled commands upfront
+	if (req.Command == BindCommand && s.config.DisableBind) ||
+		(req.Command == AssociateCommand && s.config.DisableAssociate) {
+		if err := s.sendReply(conn, CommandNotSupported, nil, req.Version); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return &ReplyError{Code: CommandNotSupported, Err: fmt.Errorf("command %v is disabled", req.Command)}
+	}
+
+	// Check blocked hostnames before any lookup
+	if req.DestAddr.FQDN != "" && hostBlocked(s.config.HostBlocklist, req.DestAddr.FQDN) {
+		if err := s.sendReply(conn, RuleFailure, nil, req.Version); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return &ReplyError{Code: RuleFailure, Err: fmt.Errorf("request to %v blocked by host blocklist", req.DestAddr)}
+	}
 
 	// Resolve the address if we have a FQDN
 	dest := req.DestAddr
 	if dest.FQDN != "" && s.config.Resolver != nil {
+		// The resolver context lives on, so it does not carry the span
+		_, span := s.startSpan(ctx, SpanResolve)
+		span.SetAttribute("socks.dest", dest.FQDN)
+		resolveStart := s.clk().Now()
 		ctx_, addr, err := s.config.Resolver.Resolve(ctx, dest.FQDN)
+		req.Timings.Resolve = s.clk().Now().Sub(resolveStart)
+		span.End(err)
 		if err != nil {
-			if err := sendReply(conn, hostUnreachable, nil, req.Version); err != nil {
-				return fmt.Errorf("failed to send reply: %v", err)
+			if err := s.sendReply(conn, HostUnreachable, nil, req.Version); err != nil {
+				return fmt.Errorf("failed to send reply: %w", err)
 			}
-			return fmt.Errorf("failed to resolve destination '%v': %v", dest.FQDN, err)
+			return &ReplyError{Code: HostUnreachable, Err: fmt.Errorf("failed to resolve destination '%v': %w", dest.FQDN, err)}
 		}
-		ctx = ctx_
+		ctx = context.WithValue(ctx_, resolvedIPKey{}, addr)
 		dest.IP = addr
+		req.Resolved = true
+		req.ResolvedIP = addr
 	}
 
 	// Apply any address rewrites
@@ -181,6 +384,30 @@ func (s *Server) handleRequest(req *Request, conn net.Conn) error {
 	if s.config.Rewriter != nil {
 		ctx, req.realDestAddr = s.config.Rewriter.Rewrite(ctx, req)
 	}
+	req.realDestAddr = s.withIPv6Zone(req.realDestAddr)
+
+	// Give the hook a chance to refuse the request
+	if s.config.AcceptRequest != nil {
+		if allow, replyCode := s.config.AcceptRequest(ctx, req); !allow {
+			if err := s.sendReply(conn, replyCode, nil, req.Version); err != nil {
+				return fmt.Errorf("failed to send reply: %w", err)
+			}
+			return &ReplyError{Code: replyCode, Err: fmt.Errorf("request to %v not accepted", req.DestAddr)}
+		}
+	}
+
+	// SOCKS4 only knows about CONNECT and BIND
+	if req.Version == socks4Version && req.Command != ConnectCommand && req.Command != BindCommand {
+		if err := s.sendReply(conn, CommandNotSupported, nil, req.Version); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return &ReplyError{Code: CommandNotSupported, Err: fmt.Errorf("%w: %v", ErrUnsupportedCommand, req.Command)}
+	}
+
+	// Custom handlers take precedence
+	if handler, ok := s.config.CommandHandlers[req.Command]; ok {
+		return handler(ctx, conn, req)
+	}
 
 	// Switch on the command
 	switch req.Command {
@@ -190,134 +417,594 @@ func (s *Server) handleRequest(req *Request, conn net.Conn) error {
 		return s.handleBind(ctx, conn, req)
 	case AssociateCommand:
 		return s.handleAssociate(ctx, conn, req)
-	default:
-		if err := sendReply(conn, commandNotSupported, nil, req.Version); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+	case ResolveCommand, ResolvePTRCommand:
+		if s.config.EnableResolveExtension {
+			return s.handleResolve(ctx, conn, req)
 		}
-		return fmt.Errorf("unsupported command: %v", req.Command)
 	}
+	if err := s.sendReply(conn, CommandNotSupported, nil, req.Version); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+	return &ReplyError{Code: CommandNotSupported, Err: fmt.Errorf("%w: %v", ErrUnsupportedCommand, req.Command)}
 }
 
 // handleConnect is used to handle a connect command
 func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) error {
+	// Port 0 can't be connected to
+	if req.DestAddr.Port == 0 && !s.config.AllowZeroPort {
+		if err := s.sendReply(conn, ServerFailure, nil, req.Version); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return &ReplyError{Code: ServerFailure, Err: fmt.Errorf("connect to %v rejected: invalid destination port 0", req.DestAddr)}
+	}
+
 	// Check if this is allowed
 	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil, req.Version); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+		if err := s.sendReply(conn, RuleFailure, nil, req.Version); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
 		}
-		return fmt.Errorf("connect to %v blocked by rules", req.DestAddr)
+		return &ReplyError{Code: RuleFailure, Err: fmt.Errorf("connect to %v blocked by rules", req.DestAddr)}
 	} else {
 		ctx = ctx_
 	}
 
-	// Attempt to connect
-	dial := s.config.Dial
-	if dial == nil {
-		dial = func(ctx context.Context, net_, addr string) (net.Conn, error) {
-			return net.Dial(net_, addr)
+	if s.config.DestinationTracker != nil {
+		s.config.DestinationTracker.Record(trackedDest(req.DestAddr))
+	}
+
+	// Give the hook a chance to serve the destination in-process
+	var target net.Conn
+	handled := false
+	if s.config.Intercept != nil {
+		var err error
+		handled, target, err = s.config.Intercept(req)
+		if err == nil && handled && target == nil {
+			err = fmt.Errorf("no connection")
+		}
+		if err != nil {
+			if target != nil {
+				target.Close()
+			}
+			if err := s.sendReply(conn, ServerFailure, nil, req.Version); err != nil {
+				return fmt.Errorf("failed to send reply: %w", err)
+			}
+			return &ReplyError{Code: ServerFailure, Err: fmt.Errorf("connect to %v intercept failed: %w", req.DestAddr, err)}
+		}
+	}
+
+	if !handled {
+		// Enforce the egress allowlist on the final address
+		if len(s.config.EgressAllow) > 0 && !s.egressAllowed(s.destIP(ctx, req)) {
+			if err := s.sendReply(conn, RuleFailure, nil, req.Version); err != nil {
+				return fmt.Errorf("failed to send reply: %w", err)
+			}
+			return &ReplyError{Code: RuleFailure, Err: fmt.Errorf("connect to %v blocked by egress allowlist", req.DestAddr)}
+		}
+
+		// Refuse cloud metadata services, whatever the other ACLs say
+		if s.config.BlockCloudMetadata && s.metadataBlocked(s.destIP(ctx, req)) {
+			if err := s.sendReply(conn, RuleFailure, nil, req.Version); err != nil {
+				return fmt.Errorf("failed to send reply: %w", err)
+			}
+			return &ReplyError{Code: RuleFailure, Err: fmt.Errorf("connect to %v blocked: cloud metadata endpoint", req.DestAddr)}
+		}
+
+		// Refuse internal destinations
+		if s.config.BlockPrivateDestinations && s.privateBlocked(s.destIP(ctx, req)) {
+			if err := s.sendReply(conn, RuleFailure, nil, req.Version); err != nil {
+				return fmt.Errorf("failed to send reply: %w", err)
+			}
+			return &ReplyError{Code: RuleFailure, Err: fmt.Errorf("connect to %v blocked: private destination", req.DestAddr)}
+		}
+
+		// Check the rules again against the resolved IP alone
+		if s.config.ReCheckResolvedIP && req.DestAddr.FQDN != "" && !s.allowResolved(ctx, req) {
+			if err := s.sendReply(conn, RuleFailure, nil, req.Version); err != nil {
+				return fmt.Errorf("failed to send reply: %w", err)
+			}
+			return &ReplyError{Code: RuleFailure, Err: fmt.Errorf("connect to %v blocked by rules on resolved address", req.DestAddr)}
+		}
+
+		// Refuse to connect to ourselves
+		if s.config.PreventLoop && s.isSelfAddr(&AddrSpec{IP: s.destIP(ctx, req), Port: req.realDestAddr.Port}) {
+			if err := s.sendReply(conn, ConnectionRefused, nil, req.Version); err != nil {
+				return fmt.Errorf("failed to send reply: %w", err)
+			}
+			return &ReplyError{Code: ConnectionRefused, Err: fmt.Errorf("connect to %v refused: destination is the proxy itself", req.DestAddr)}
+		}
+
+		// Let the user veto the final address
+		if s.config.AllowDial != nil {
+			if err := s.config.AllowDial(ctx, req, s.destIP(ctx, req), req.realDestAddr.Port); err != nil {
+				if err := s.sendReply(conn, RuleFailure, nil, req.Version); err != nil {
+					return fmt.Errorf("failed to send reply: %w", err)
+				}
+				return &ReplyError{Code: RuleFailure, Err: fmt.Errorf("connect to %v blocked: %w", req.DestAddr, err)}
+			}
+		}
+
+		// Reuse a pooled connection if there is one
+		pooled := false
+		if s.config.ConnPool != nil {
+			target, pooled = s.config.ConnPool.Get(req.realDestAddr.Address())
+		}
+		if !pooled {
+			// Attempt to connect
+			dial := s.config.Dial
+			if dial == nil && s.config.UpstreamHTTPProxy != "" {
+				dial = s.dialHTTPProxy
+			}
+			if dial == nil && s.config.UpstreamSOCKS5Proxy != "" {
+				dial = func(ctx context.Context, net_, addr string) (net.Conn, error) {
+					return s.dialSOCKS5Proxy(ctx, net_, addr, req)
+				}
+			}
+			if dial == nil {
+				dial = func(ctx context.Context, net_, addr string) (net.Conn, error) {
+					d := net.Dialer{Control: s.socketControl()}
+					return d.DialContext(ctx, net_, addr)
+				}
+			}
+			dialCtx, span := s.startSpan(ctx, SpanDial)
+			span.SetAttribute("socks.dest", req.realDestAddr.Address())
+			var err error
+			dialStart := s.clk().Now()
+			target, err = dial(dialCtx, "tcp", req.realDestAddr.Address())
+			for i := 0; err != nil && i < s.config.DialRetries && isTransientDialError(err); i++ {
+				if s.config.DialRetryBackoff > 0 {
+					<-s.clk().After(s.config.DialRetryBackoff)
+				}
+				target, err = dial(dialCtx, "tcp", req.realDestAddr.Address())
+			}
+			req.Timings.Dial = s.clk().Now().Sub(dialStart)
+			span.End(err)
+			if err != nil {
+				msg := err.Error()
+				resp := HostUnreachable
+				var httpErr *httpConnectError
+				var replyErr *ReplyError
+				if errors.As(err, &httpErr) {
+					resp = httpErr.reply()
+				} else if errors.As(err, &replyErr) {
+					resp = replyErr.Code
+				} else if strings.Contains(msg, "refused") {
+					resp = ConnectionRefused
+				} else if strings.Contains(msg, "network is unreachable") {
+					resp = NetworkUnreachable
+				}
+				if err := s.sendReply(conn, resp, nil, req.Version); err != nil {
+					return fmt.Errorf("failed to send reply: %w", err)
+				}
+				return &ReplyError{Code: resp, Err: fmt.Errorf("connect to %v failed: %w", req.DestAddr, err)}
+			}
 		}
 	}
-	target, err := dial(ctx, "tcp", req.realDestAddr.Address())
-	if err != nil {
-		msg := err.Error()
-		resp := hostUnreachable
-		if strings.Contains(msg, "refused") {
-			resp = connectionRefused
-		} else if strings.Contains(msg, "network is unreachable") {
-			resp = networkUnreachable
+
+	// A connection nothing was written to goes back to the pool,
+	// whatever ends the request
+	dialed := target
+	reusable := s.config.ConnPool != nil && !handled
+	defer func() {
+		if reusable {
+			s.config.ConnPool.Put(req.realDestAddr.Address(), dialed)
+		} else {
+			dialed.Close()
 		}
-		if err := sendReply(conn, resp, nil, req.Version); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+	}()
+	s.tuneConn(rawConn(target))
+	req.EgressLocalAddr = target.LocalAddr()
+	req.EgressRemoteAddr = target.RemoteAddr()
+	local, ok := target.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		local = &net.TCPAddr{IP: net.IPv4zero}
+	}
+
+	// Speak TLS to the destination if asked to
+	if !handled {
+		wrapped, err := s.destTLS(ctx, req, target)
+		if err != nil || wrapped != target {
+			reusable = false
+		}
+		if err != nil {
+			if err := s.sendReply(conn, HostUnreachable, nil, req.Version); err != nil {
+				return fmt.Errorf("failed to send reply: %w", err)
+			}
+			return &ReplyError{Code: HostUnreachable, Err: fmt.Errorf("connect to %v failed: tls handshake: %w", req.DestAddr, err)}
+		}
+		if wrapped != target {
+			target = wrapped
+			defer target.Close()
+		}
+	}
+
+	// Give the hook a chance to wrap the connection
+	if s.config.OnDial != nil {
+		reusable = false
+		wrapped, err := s.config.OnDial(req, target)
+		if err != nil {
+			if err := s.sendReply(conn, ServerFailure, nil, req.Version); err != nil {
+				return fmt.Errorf("failed to send reply: %w", err)
+			}
+			return &ReplyError{Code: ServerFailure, Err: fmt.Errorf("connect to %v aborted: %w", req.DestAddr, err)}
+		}
+		target = wrapped
+		defer target.Close()
+	}
+
+	if s.config.TuneConn != nil {
+		s.config.TuneConn(req, rawConn(conn), target)
+	}
+
+	// Set up proxying, compressed with the client if agreed on
+	upstream := req.bufConn
+	relayConn := conn
+	if req.compressed {
+		nc, ok := conn.(net.Conn)
+		if !ok {
+			return fmt.Errorf("compressed relay needs a net.Conn")
+		}
+		cc, err := newCompressedConn(s.config.RelayCompression, nc, req.bufConn)
+		if err != nil {
+			if err := s.sendReply(conn, ServerFailure, nil, req.Version); err != nil {
+				return fmt.Errorf("failed to send reply: %w", err)
+			}
+			return &ReplyError{Code: ServerFailure, Err: fmt.Errorf("connect to %v aborted: compression: %w", req.DestAddr, err)}
+		}
+		upstream, relayConn = cc, cc
+	}
+	src := s.tap(req, TapUpstream, upstream)
+	dst := s.tap(req, TapDownstream, target)
+	if s.config.IdleTimeout > 0 {
+		idle := s.newIdleWatcher(s.config.IdleTimeout, target)
+		defer idle.stop()
+		src = idle.reader(src)
+		dst = idle.reader(dst)
+	}
+
+	// Forward what the client already sent along with the request, such
+	// as the first request of request-first protocols, right away.
+	// Compressed data is left to the relay
+	early := 0
+	if !req.compressed {
+		early = bufferedLen(req.bufConn)
+	}
+	if early > 0 {
+		reusable = false
+		if _, err := io.CopyN(target, src, int64(early)); err != nil {
+			if err := s.sendReply(conn, HostUnreachable, nil, req.Version); err != nil {
+				return fmt.Errorf("failed to send reply: %w", err)
+			}
+			return &ReplyError{Code: HostUnreachable, Err: fmt.Errorf("connect to %v failed: %w", req.DestAddr, err)}
 		}
-		return fmt.Errorf("connect to %v failed: %v", req.DestAddr, err)
 	}
-	defer target.Close()
 
 	// Send success
-	local := target.LocalAddr().(*net.TCPAddr)
 	bind := AddrSpec{IP: local.IP, Port: local.Port}
-	if err := sendReply(conn, successReply, &bind, req.Version); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
+	if s.config.ReplyWithRequestedAddr && req.DestAddr.FQDN != "" {
+		bind = AddrSpec{FQDN: req.DestAddr.FQDN, Port: local.Port}
+	}
+	if req.Version == socks4Version {
+		// SOCKS4 clients expect the destination to be echoed, with the
+		// IP a SOCKS4a hostname resolved to
+		bind = AddrSpec{IP: req.DestAddr.IP, Port: req.DestAddr.Port}
+	}
+	if err := s.sendReply(conn, SuccessReply, &bind, req.Version); err != nil {
+		s.config.Logger.Printf("[ERR] socks: conn %d: dropping connection to %v: failed to send reply: %v", req.ConnID, req.DestAddr, err)
+		return fmt.Errorf("failed to send reply: %w", err)
 	}
 
-	// Start proxying
-	errCh := make(chan error, 2)
-	go proxy(target, req.bufConn, errCh)
-	go proxy(conn, target, errCh)
+	// Start proxying, the target is consumed
+	reusable = false
+	return s.relay(ctx, relayConn, target, src, dst)
+}
 
-	// Wait
-	for i := 0; i < 2; i++ {
-		e := <-errCh
-		if e != nil {
-			// return from this function closes target (and conn).
-			return e
-		}
+// bufferedLen returns how many bytes r holds that were already read
+// from the connection, and so can be read without blocking
+func bufferedLen(r io.Reader) int {
+	if b, ok := r.(interface{ Buffered() int }); ok {
+		return b.Buffered()
 	}
-	return nil
+	return 0
 }
 
-// handleBind is used to handle a connect command
+// handleBind is used to handle a bind command
 func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error {
 	// Check if this is allowed
-	if _, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil, req.Version); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
+		if err := s.sendReply(conn, RuleFailure, nil, req.Version); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
 		}
-		return fmt.Errorf("bind to %v blocked by rules", req.DestAddr)
+		return &ReplyError{Code: RuleFailure, Err: fmt.Errorf("bind to %v blocked by rules", req.DestAddr)}
+	} else {
+		ctx = ctx_
 	}
 
-	// TODO: Support bind
-	if err := sendReply(conn, commandNotSupported, nil, req.Version); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: s.bindIP(), Port: s.config.BindPort})
+	if err != nil {
+		if err := s.sendReply(conn, ServerFailure, nil, req.Version); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return &ReplyError{Code: ServerFailure, Err: fmt.Errorf("failed to listen for bind: %w", err)}
 	}
-	return nil
+	defer ln.Close()
+
+	// Send the first reply, with the address the peer should connect to
+	local := ln.Addr().(*net.TCPAddr)
+	advertisedIP, advertisedPort := local.IP, local.Port
+	if s.config.BindAdvertisePort != nil {
+		ip, port := s.config.BindAdvertisePort(local)
+		if ip != nil {
+			advertisedIP = ip
+		}
+		advertisedPort = port
+	}
+	bindAddr := s.advertisedAddr(advertisedIP, advertisedPort)
+	if err := s.sendReply(conn, SuccessReply, &bindAddr, req.Version); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+
+	// Wait for the expected peer. Peers connecting from another
+	// address are rejected and we keep waiting
+	timeout := s.config.BindTimeout
+	if timeout == 0 {
+		timeout = defaultBindTimeout
+	}
+	ln.SetDeadline(time.Now().Add(timeout))
+	var target *net.TCPConn
+	for target == nil {
+		peer, err := ln.AcceptTCP()
+		if err != nil {
+			resp := ServerFailure
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				resp = TtlExpired
+			}
+			if err := s.sendReply(conn, resp, nil, req.Version); err != nil {
+				return fmt.Errorf("failed to send reply: %w", err)
+			}
+			return &ReplyError{Code: resp, Err: fmt.Errorf("bind for %v failed: %w", req.DestAddr, err)}
+		}
+		remote := peer.RemoteAddr().(*net.TCPAddr)
+		if !isExpectedBindPeer(req.realDestAddr, remote.IP) {
+			s.config.Logger.Printf("[ERR] socks: conn %d: rejecting unexpected bind peer %v for %v", req.ConnID, remote, req.DestAddr)
+			peer.Close()
+			continue
+		}
+		target = peer
+	}
+	defer target.Close()
+
+	// Send the second reply, with the address of the connected peer
+	remote := target.RemoteAddr().(*net.TCPAddr)
+	peerAddr := AddrSpec{IP: remote.IP, Port: remote.Port}
+	if err := s.sendReply(conn, SuccessReply, &peerAddr, req.Version); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+
+	// Start proxying
+	return s.relay(ctx, conn, target, s.tap(req, TapUpstream, req.bufConn), s.tap(req, TapDownstream, target))
+}
+
+// isExpectedBindPeer reports whether a peer connecting from ip is the one
+// announced in the BIND request. Any peer is accepted if the request
+// has no address
+func isExpectedBindPeer(dest *AddrSpec, ip net.IP) bool {
+	if dest == nil || len(dest.IP) == 0 || dest.IP.IsUnspecified() {
+		return true
+	}
+	return dest.IP.Equal(ip)
 }
 
-// handleAssociate is used to handle a connect command
+// allowResolved evaluates the rules on a copy of req whose destination
+// is the final IP, without the FQDN
+func (s *Server) allowResolved(ctx context.Context, req *Request) bool {
+	ip := s.destIP(ctx, req)
+	if ip == nil {
+		return false
+	}
+	resolved := *req
+	resolved.DestAddr = &AddrSpec{IP: ip, Port: req.realDestAddr.Port}
+	_, ok := s.config.Rules.Allow(ctx, &resolved)
+	return ok
+}
+
+// withIPv6Zone returns a copy of addr scoped to Config.DefaultIPv6Zone
+// if it is an IPv6 link-local address without a zone
+func (s *Server) withIPv6Zone(addr *AddrSpec) *AddrSpec {
+	if s.config.DefaultIPv6Zone == "" || addr == nil || addr.Zone != "" ||
+		addr.IP.To4() != nil || !addr.IP.IsLinkLocalUnicast() {
+		return addr
+	}
+	scoped := *addr
+	scoped.Zone = s.config.DefaultIPv6Zone
+	return &scoped
+}
+
+// advertisedAddr returns the address to report in bind and udp
+// associate replies, using Config.AdvertiseHost if set
+func (s *Server) advertisedAddr(ip net.IP, port int) AddrSpec {
+	if s.config.AdvertiseHost != "" {
+		return AddrSpec{FQDN: s.config.AdvertiseHost, Port: port}
+	}
+	return AddrSpec{IP: ip, Port: port}
+}
+
+// bindIP returns the IP to use for bind or udp associate
+func (s *Server) bindIP() net.IP {
+	if len(s.config.BindIP) == 0 || s.config.BindIP.IsUnspecified() {
+		return net.ParseIP("127.0.0.1")
+	}
+	return s.config.BindIP
+}
+
+// relayIP returns the IP the udp relay listens on. Unless BindIP is
+// set, it's the address the client reached us at, so that it is
+// reachable from the client, and of the same family
+func (s *Server) relayIP(conn net.Conn) net.IP {
+	if len(s.config.BindIP) != 0 && !s.config.BindIP.IsUnspecified() {
+		return s.config.BindIP
+	}
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok || local.IP == nil || local.IP.IsUnspecified() {
+		return s.bindIP()
+	}
+	// Clients of dual-stack sockets use v4-mapped addresses
+	if ip4 := local.IP.To4(); ip4 != nil {
+		return ip4
+	}
+	return local.IP
+}
+
+// handleAssociate is used to handle an associate command
 func (s *Server) handleAssociate(ctx context.Context, conn net.Conn, req *Request) error {
 	// Check if this is allowed
-	if _, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil, req.Version); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
+		if err := s.sendReply(conn, RuleFailure, nil, req.Version); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
 		}
-		return fmt.Errorf("connect to %v blocked by rules", req.DestAddr)
+		return &ReplyError{Code: RuleFailure, Err: fmt.Errorf("associate to %v blocked by rules", req.DestAddr)}
+	} else {
+		ctx = ctx_
 	}
-	// check bindIP 1st
-	if len(s.config.BindIP) == 0 || s.config.BindIP.IsUnspecified() {
-		s.config.BindIP = net.ParseIP("127.0.0.1")
+	relayIP := s.relayIP(conn)
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: relayIP, Port: s.config.BindPort})
+	if err != nil {
+		if err := s.sendReply(conn, ServerFailure, nil, req.Version); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return &ReplyError{Code: ServerFailure, Err: fmt.Errorf("failed to listen for udp associate: %w", err)}
 	}
+	defer relay.Close()
 
-	bindAddr := AddrSpec{IP: s.config.BindIP, Port: s.config.BindPort}
+	listenPacket := s.config.ListenPacket
+	if listenPacket == nil {
+		listenPacket = func(ctx context.Context, net_, addr string) (net.PacketConn, error) {
+			lc := net.ListenConfig{Control: s.socketControl()}
+			return lc.ListenPacket(ctx, net_, addr)
+		}
+	}
+	egress := ":0"
+	if len(s.config.LocalAddr) != 0 {
+		egress = net.JoinHostPort(s.config.LocalAddr.String(), "0")
+	}
+	target, err := listenPacket(ctx, "udp", egress)
+	if err != nil {
+		if err := s.sendReply(conn, ServerFailure, nil, req.Version); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return &ReplyError{Code: ServerFailure, Err: fmt.Errorf("failed to open udp associate socket (is udp available?): %w", err)}
+	}
+	defer target.Close()
 
-	if err := sendReply(conn, successReply, &bindAddr, req.Version); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
+	// Without a stable source port, destinations after the first one
+	// get their own socket
+	var newTarget func() (net.PacketConn, error)
+	if !s.config.UDPStableSourcePort {
+		newTarget = func() (net.PacketConn, error) {
+			return listenPacket(ctx, "udp", egress)
+		}
 	}
 
-	// wait here till the client close the connection
-	// check every 10 secs
-	tmp := []byte{}
-	var neverTimeout time.Time
-	for {
-		conn.SetReadDeadline(time.Now())
-		if _, err := conn.Read(tmp); err == io.EOF {
-			break
-		} else {
-			conn.SetReadDeadline(neverTimeout)
+	local := relay.LocalAddr().(*net.UDPAddr)
+	bindAddr := s.advertisedAddr(relayIP, local.Port)
+
+	// Make sure the address can be sent before committing to it
+	if _, err := encodeAddrSpecV5(&bindAddr); err != nil {
+		if err := s.sendReply(conn, ServerFailure, nil, req.Version); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
 		}
-		time.Sleep(10 * time.Second)
+		return &ReplyError{Code: ServerFailure, Err: fmt.Errorf("failed to advertise udp relay address %v: %w", bindAddr, err)}
+	}
+
+	if err := s.sendReply(conn, SuccessReply, &bindAddr, req.Version); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+
+	// Start relaying
+	var idle *idleWatcher
+	idleCh := make(chan struct{})
+	if s.config.UDPIdleTimeout > 0 {
+		idle = s.newIdleWatcher(s.config.UDPIdleTimeout, closerFunc(func() error {
+			close(idleCh)
+			return nil
+		}))
+		defer idle.stop()
+	}
+	go s.relayUDP(ctx, relay, target, newTarget, req, idle)
+
+	// The association lasts as long as the control connection: wait
+	// here till the client closes it, or till the association expires.
+	// Returning closes the sockets, stopping the relay
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, req.bufConn)
+		close(closed)
+	}()
+
+	var expired <-chan time.Time
+	if s.config.UDPAssociationMaxLifetime > 0 {
+		t := s.clk().NewTimer(s.config.UDPAssociationMaxLifetime)
+		defer t.Stop()
+		expired = t.C()
+	}
+
+	select {
+	case <-closed:
+	case <-expired:
+		s.config.Logger.Printf("[INFO] socks: conn %d: udp association for %v expired", req.ConnID, req.RemoteAddr)
+	case <-idleCh:
+		s.config.Logger.Printf("[INFO] socks: conn %d: udp association for %v idle", req.ConnID, req.RemoteAddr)
 	}
 
 	return nil
 }
 
+// handleResolve is used to handle the RESOLVE and RESOLVE_PTR commands.
+// The answer is sent in the bound address of the reply
+func (s *Server) handleResolve(ctx context.Context, conn conn, req *Request) error {
+	var answer AddrSpec
+	var err error
+	if req.Command == ResolveCommand {
+		// FQDNs were resolved along with the request, unless there is
+		// no Resolver
+		answer.IP = req.DestAddr.IP
+		if answer.IP == nil {
+			_, answer.IP, err = DNSResolver{}.Resolve(ctx, req.DestAddr.FQDN)
+		}
+	} else if req.DestAddr.IP == nil {
+		err = fmt.Errorf("not an IP address")
+	} else {
+		var names []string
+		names, err = net.DefaultResolver.LookupAddr(ctx, req.DestAddr.IP.String())
+		if err == nil && len(names) == 0 {
+			err = fmt.Errorf("no name found")
+		}
+		if err == nil {
+			answer.FQDN = strings.TrimSuffix(names[0], ".")
+		}
+	}
+	if err != nil {
+		if err := s.sendReply(conn, HostUnreachable, nil, req.Version); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return &ReplyError{Code: HostUnreachable, Err: fmt.Errorf("failed to resolve %v: %w", req.DestAddr, err)}
+	}
+
+	if err := s.sendReply(conn, SuccessReply, &answer, req.Version); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+	return nil
+}
+
 // readAddrSpecV5 is used to read AddrSpec.
 // Expects an address type byte, follwed by the address and port
-func readAddrSpecV5(r io.Reader) (*AddrSpec, error) {
+// Unknown address types are parsed by the matching custom function,
+// which reads the rest of the address, port included.
+func readAddrSpecV5(r io.Reader, custom map[uint8]func(io.Reader) (*AddrSpec, error)) (*AddrSpec, error) {
 	d := &AddrSpec{}
 
 	// Get the address type
 	addrType := []byte{0}
-	if _, err := r.Read(addrType); err != nil {
+	if _, err := io.ReadFull(r, addrType); err != nil {
 		return nil, err
 	}
 
@@ -338,18 +1025,32 @@ func readAddrSpecV5(r io.Reader) (*AddrSpec, error) {
 		d.IP = net.IP(addr)
 
 	case FqdnAddress:
-		if _, err := r.Read(addrType); err != nil {
+		if _, err := io.ReadFull(r, addrType); err != nil {
 			return nil, err
 		}
 		addrLen := int(addrType[0])
+		if addrLen == 0 {
+			return nil, fmt.Errorf("empty fqdn")
+		}
 		fqdn := make([]byte, addrLen)
 		if _, err := io.ReadAtLeast(r, fqdn, addrLen); err != nil {
 			return nil, err
 		}
+		if !validFQDN(string(fqdn)) {
+			return nil, fmt.Errorf("invalid fqdn %q", fqdn)
+		}
 		d.FQDN = string(fqdn)
 
 	default:
-		return nil, ErrUnrecognizedAddrType
+		parse, ok := custom[addrType[0]]
+		if !ok {
+			return nil, ErrUnrecognizedAddrType
+		}
+		addr, err := parse(r)
+		if err == nil && addr == nil {
+			return nil, fmt.Errorf("no address parsed for address type %d", addrType[0])
+		}
+		return addr, err
 	}
 
 	// Read the port
@@ -362,6 +1063,18 @@ func readAddrSpecV5(r io.Reader) (*AddrSpec, error) {
 	return d, nil
 }
 
+// validFQDN reports whether name holds no whitespace or control
+// characters, which could be used to smuggle data into the protocols
+// the name is later written to, such as an HTTP CONNECT
+func validFQDN(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
 // Expects port, follwed by the address
 func readAddrSpecV4(r io.Reader) (*AddrSpec, error) {
 	d := &AddrSpec{}
@@ -383,82 +1096,191 @@ func readAddrSpecV4(r io.Reader) (*AddrSpec, error) {
 	return d, nil
 }
 
-func readUntilNull(r io.Reader) (string, error) {
+// readUntilNull is used to read a NUL terminated string, of at most
+// max bytes
+func readUntilNull(r io.Reader, max int) (string, error) {
 	var buf []byte
 	var data [1]byte
 
 	for {
-		_, err := r.Read(data[:])
+		_, err := io.ReadFull(r, data[:])
+		if err == io.EOF && len(buf) != 0 {
+			err = io.ErrUnexpectedEOF
+		}
 		if err != nil {
 			return "", err
 		}
 		if data[0] == 0 {
 			return string(buf), nil
 		}
+		if len(buf) == max {
+			return "", fmt.Errorf("string longer than %d bytes", max)
+		}
 		buf = append(buf, data[0])
 	}
 }
 
+// encodeAddrSpecV5 is used to format an AddrSpec as an address type
+// byte, followed by the address and port. A nil addr is encoded as
+// the IPv4 zero address
+func encodeAddrSpecV5(addr *AddrSpec) ([]byte, error) {
+	var addrType uint8
+	var addrBody []byte
+	var addrPort uint16
+	switch {
+	case addr == nil:
+		addrType = Ipv4Address
+		addrBody = []byte{0, 0, 0, 0}
+		addrPort = 0
+
+	case addr.FQDN != "":
+		if len(addr.FQDN) > 255 {
+			return nil, fmt.Errorf("failed to format address: name too long: %d bytes", len(addr.FQDN))
+		}
+		addrType = FqdnAddress
+		addrBody = append([]byte{byte(len(addr.FQDN))}, addr.FQDN...)
+		addrPort = uint16(addr.Port)
+
+	case addr.IP.To4() != nil:
+		addrType = Ipv4Address
+		addrBody = []byte(addr.IP.To4())
+		addrPort = uint16(addr.Port)
+
+	case addr.IP.To16() != nil:
+		addrType = Ipv6Address
+		addrBody = []byte(addr.IP.To16())
+		addrPort = uint16(addr.Port)
+
+	default:
+		return nil, fmt.Errorf("failed to format address: %v", addr)
+	}
+
+	msg := make([]byte, 1+len(addrBody)+2)
+	msg[0] = addrType
+	copy(msg[1:], addrBody)
+	msg[1+len(addrBody)] = byte(addrPort >> 8)
+	msg[1+len(addrBody)+1] = byte(addrPort & 0xff)
+	return msg, nil
+}
+
+type serverKey struct{}
+
+// SendReply sends a reply to a request, for the given protocol version.
+// resp is one of the RFC 1928 reply codes, addr the bound address
+// (may be nil). It can be used by Config.CommandHandlers and middlewares:
+// given their ctx, it replies like the server does, applying
+// ReplyVersion, WriteTimeout and FailureDelay. Other contexts get the
+// bare reply
+func SendReply(ctx context.Context, w io.Writer, resp uint8, addr *AddrSpec, version uint8) error {
+	if s, ok := ctx.Value(serverKey{}).(*Server); ok {
+		return s.sendReply(w, resp, addr, version)
+	}
+	return sendReply(w, resp, addr, version)
+}
+
+// sendReply is used to send a reply message to the client, giving up
+// after Config.WriteTimeout. All the server replies go through it.
+// Failures are delayed by Config.FailureDelay
+func (s *Server) sendReply(w io.Writer, resp uint8, addr *AddrSpec, version byte) error {
+	if resp != SuccessReply {
+		s.failureDelay()
+	}
+	if d, ok := w.(writeDeadliner); ok && s.config.WriteTimeout > 0 {
+		d.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
+		defer d.SetWriteDeadline(time.Time{})
+	}
+
+	msg, err := formatReply(resp, addr, version)
+	if err != nil {
+		return err
+	}
+	if version == socks5Version && s.config.ReplyVersion != 0 {
+		msg[0] = s.config.ReplyVersion
+	}
+	_, err = w.Write(msg)
+	return err
+}
+
+// failureDelay waits for Config.FailureDelay before a failure is
+// reported, to slow down scanners. A forced Shutdown cuts it short
+func (s *Server) failureDelay() {
+	if s.config.FailureDelay <= 0 {
+		return
+	}
+	select {
+	case <-s.clk().After(s.config.FailureDelay):
+	case <-s.baseContext().Done():
+	}
+}
+
+// authFailureWriter delays the failure status of the username/password
+// sub-negotiation by Config.FailureDelay
+type authFailureWriter struct {
+	io.Writer
+	s *Server
+}
+
+func (w *authFailureWriter) Write(b []byte) (int, error) {
+	if len(b) == 2 && b[0] == userAuthVersion && b[1] != authSuccess {
+		w.s.failureDelay()
+	}
+	return w.Writer.Write(b)
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
 // sendReply is used to send a reply message
 func sendReply(w io.Writer, resp uint8, addr *AddrSpec, version byte) error {
+	msg, err := formatReply(resp, addr, version)
+	if err != nil {
+		return err
+	}
+
+	// Send the message
+	_, err = w.Write(msg)
+	return err
+}
+
+// formatReply is used to format a reply message
+func formatReply(resp uint8, addr *AddrSpec, version byte) ([]byte, error) {
 	var msg []byte
 	switch version {
 	case socks5Version:
 		// Format the address
-		var addrType uint8
-		var addrBody []byte
-		var addrPort uint16
-		switch {
-		case addr == nil:
-			addrType = Ipv4Address
-			addrBody = []byte{0, 0, 0, 0}
-			addrPort = 0
-
-		case addr.FQDN != "":
-			addrType = FqdnAddress
-			addrBody = append([]byte{byte(len(addr.FQDN))}, addr.FQDN...)
-			addrPort = uint16(addr.Port)
-
-		case addr.IP.To4() != nil:
-			addrType = Ipv4Address
-			addrBody = []byte(addr.IP.To4())
-			addrPort = uint16(addr.Port)
-
-		case addr.IP.To16() != nil:
-			addrType = Ipv6Address
-			addrBody = []byte(addr.IP.To16())
-			addrPort = uint16(addr.Port)
-
-		default:
-			return fmt.Errorf("failed to format address: %v", addr)
+		addrBody, err := encodeAddrSpecV5(addr)
+		if err != nil {
+			return nil, err
 		}
 
 		// Format the message
-		msg = make([]byte, 6+len(addrBody))
+		msg = make([]byte, 3+len(addrBody))
 		msg[0] = socks5Version
 		msg[1] = resp
 		msg[2] = 0 // Reserved
-		msg[3] = addrType
-		copy(msg[4:], addrBody)
-		msg[4+len(addrBody)] = byte(addrPort >> 8)
-		msg[4+len(addrBody)+1] = byte(addrPort & 0xff)
+		copy(msg[3:], addrBody)
 
 	case socks4Version:
 		msg = make([]byte, 8)
 		msg[0] = 0
-		if resp == successReply {
+		if resp == SuccessReply {
 			msg[1] = 0x5a
 		} else {
 			msg[1] = 0x5b
 		}
-		// bytes 3-8 are reserved
+		// Then the port and IPv4 address, zero if there is none
+		if addr != nil {
+			if ip4 := addr.IP.To4(); ip4 != nil {
+				binary.BigEndian.PutUint16(msg[2:4], uint16(addr.Port))
+				copy(msg[4:8], ip4)
+			}
+		}
 	default:
-		return fmt.Errorf("unsupported socks version: %d", version)
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
 	}
 
-	// Send the message
-	_, err := w.Write(msg)
-	return err
+	return msg, nil
 }
 
 type closeWriter interface {
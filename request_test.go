@@ -1,15 +1,24 @@
 package socks
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 type MockConn struct {
@@ -146,7 +155,10 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 		t.Fatalf("err: %v", err)
 	}
 
-	// Verify response
+	// Verify response: the rule failure code is 2 on the wire
+	if RuleFailure != 2 {
+		t.Fatalf("bad: %v", RuleFailure)
+	}
 	out := resp.buf.Bytes()
 	expected := []byte{
 		5,
@@ -161,3 +173,2174 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 		t.Fatalf("bad: %v %v", out, expected)
 	}
 }
+
+func TestRequest_Connect_IPv6(t *testing.T) {
+	// Create a local IPv6 listener
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	// Make server
+	s := &Server{config: &Config{
+		Rules:  PermitAll(),
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	// Create the connect request
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, Ipv6Address})
+	buf.Write(net.IPv6loopback)
+	binary.Write(buf, binary.BigEndian, uint16(lAddr.Port))
+	buf.Write([]byte("ping"))
+
+	resp := &MockConn{}
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.handleRequest(req, resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Verify the IPv6 bind address, ignoring the port, and the echo
+	out := resp.buf.Bytes()
+	expected := append([]byte{5, 0, 0, Ipv6Address}, net.IPv6loopback...)
+	if len(out) != len(expected)+2+4 || !bytes.Equal(out[:len(expected)], expected) {
+		t.Fatalf("bad: %v", out)
+	}
+	if string(out[len(expected)+2:]) != "ping" {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+// staticResolver resolves every name to the same IP
+type staticResolver net.IP
+
+func (r staticResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, net.IP(r), nil
+}
+
+func TestRequest_Connect_ReplyWithRequestedAddr(t *testing.T) {
+	for _, replyWithRequested := range []bool{false, true} {
+		// Create a local listener
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		go func() {
+			conn, _ := l.Accept()
+			conn.Close()
+		}()
+		lAddr := l.Addr().(*net.TCPAddr)
+
+		// Make server
+		s := &Server{config: &Config{
+			Rules:                  PermitAll(),
+			Resolver:               staticResolver(net.IPv4(127, 0, 0, 1)),
+			ReplyWithRequestedAddr: replyWithRequested,
+			Logger:                 log.New(os.Stdout, "", log.LstdFlags),
+		}}
+
+		// Create the connect request
+		buf := bytes.NewBuffer(nil)
+		buf.Write([]byte{5, 1, 0, 3, 9})
+		buf.Write([]byte("localhost"))
+
+		port := []byte{0, 0}
+		binary.BigEndian.PutUint16(port, uint16(lAddr.Port))
+		buf.Write(port)
+
+		// Handle the request
+		resp := &MockConn{}
+		req, err := NewRequest(buf, socks5Version)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		if err := s.handleRequest(req, resp); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		l.Close()
+
+		// Verify response, ignoring the port
+		out := resp.buf.Bytes()
+		expected := []byte{5, 0, 0, 1, 127, 0, 0, 1}
+		if replyWithRequested {
+			expected = append([]byte{5, 0, 0, 3, 9}, "localhost"...)
+		}
+		if len(out) != len(expected)+2 || !bytes.Equal(out[:len(expected)], expected) {
+			t.Fatalf("bad: %v %v", out, expected)
+		}
+	}
+}
+
+func TestRequest_Connect_Resolved(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, _ := l.Accept()
+		conn.Close()
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	var seen *Request
+	s := &Server{config: &Config{
+		Rules:    PermitAll(),
+		Resolver: staticResolver(net.IPv4(127, 0, 0, 1)),
+		OnDial: func(req *Request, target net.Conn) (net.Conn, error) {
+			seen = req
+			return target, nil
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 3, 9})
+	buf.Write([]byte("localhost"))
+	port := []byte{0, 0}
+	binary.BigEndian.PutUint16(port, uint16(lAddr.Port))
+	buf.Write(port)
+
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.handleRequest(req, &MockConn{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if seen == nil || !seen.Resolved || !seen.ResolvedIP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("bad: %v", seen)
+	}
+	if seen.ResolvedIP.To4() == nil {
+		t.Fatalf("bad: %v", seen.ResolvedIP)
+	}
+
+	// An IP literal is not resolved
+	buf.Reset()
+	buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1})
+	buf.Write(port)
+	req, err = NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		conn, _ := l.Accept()
+		conn.Close()
+	}()
+	if err := s.handleRequest(req, &MockConn{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if seen.Resolved || seen.ResolvedIP != nil {
+		t.Fatalf("bad: %v", seen)
+	}
+
+	// Nor is a hostname without a Resolver
+	s.config.Resolver = nil
+	buf.Reset()
+	buf.Write([]byte{5, 1, 0, 3, 9})
+	buf.Write([]byte("localhost"))
+	buf.Write(port)
+	req, err = NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		conn, _ := l.Accept()
+		conn.Close()
+	}()
+	if err := s.handleRequest(req, &MockConn{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if seen.Resolved || seen.ResolvedIP != nil {
+		t.Fatalf("bad: %v", seen)
+	}
+}
+
+// closedConn is a client connection that is gone
+type closedConn struct {
+	MockConn
+}
+
+func (c *closedConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// trackedConn records whether it was closed
+type trackedConn struct {
+	net.Conn
+	closed int32
+}
+
+func (c *trackedConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return c.Conn.Close()
+}
+
+func TestRequest_Connect_ReplyFails(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, _ := l.Accept()
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	var dialed *trackedConn
+	s := &Server{config: &Config{
+		Rules: PermitAll(),
+		Dial: func(ctx context.Context, net_, addr string) (net.Conn, error) {
+			conn, err := net.Dial(net_, addr)
+			if err != nil {
+				return nil, err
+			}
+			dialed = &trackedConn{Conn: conn}
+			return dialed, nil
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1})
+	port := []byte{0, 0}
+	binary.BigEndian.PutUint16(port, uint16(lAddr.Port))
+	buf.Write(port)
+
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.handleRequest(req, &closedConn{}); err == nil {
+		t.Fatalf("expected error")
+	}
+	if dialed == nil || atomic.LoadInt32(&dialed.closed) != 1 {
+		t.Fatalf("outbound connection leaked")
+	}
+}
+
+func TestRequest_AcceptRequest(t *testing.T) {
+	// Make server
+	var seen *Request
+	s := &Server{config: &Config{
+		Rules:  PermitAll(),
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+		AcceptRequest: func(ctx context.Context, req *Request) (bool, uint8) {
+			seen = req
+			return false, ConnectionRefused
+		},
+	}}
+
+	// Create the connect request
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+
+	// Handle the request
+	resp := &MockConn{}
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := s.handleRequest(req, resp); err == nil || !strings.Contains(err.Error(), "not accepted") {
+		t.Fatalf("err: %v", err)
+	}
+	if seen != req {
+		t.Fatalf("hook did not see the request")
+	}
+
+	// Verify response
+	out := resp.buf.Bytes()
+	expected := []byte{
+		5,
+		ConnectionRefused,
+		0,
+		1,
+		0, 0, 0, 0,
+		0, 0,
+	}
+
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v %v", out, expected)
+	}
+}
+
+func TestRequest_Bind(t *testing.T) {
+	// Make server
+	s := &Server{config: &Config{
+		Rules:  PermitAll(),
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	// Create the bind request, expecting a peer from loopback
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, BindCommand, 0, 1, 127, 0, 0, 1, 0, 0})
+
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handleRequest(req, server)
+
+	// Read the first reply and connect to the announced address
+	client.SetDeadline(time.Now().Add(time.Second))
+	out := make([]byte, 10)
+	if _, err := io.ReadFull(client, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out[:8], []byte{5, SuccessReply, 0, 1, 127, 0, 0, 1}) {
+		t.Fatalf("bad: %v", out)
+	}
+	bindPort := binary.BigEndian.Uint16(out[8:])
+	peer, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(bindPort))))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer peer.Close()
+
+	// The second reply reports the peer address
+	if _, err := io.ReadFull(client, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	peerAddr := peer.LocalAddr().(*net.TCPAddr)
+	expected := []byte{5, SuccessReply, 0, 1, 127, 0, 0, 1, 0, 0}
+	binary.BigEndian.PutUint16(expected[8:], uint16(peerAddr.Port))
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v %v", out, expected)
+	}
+
+	// Data flows from the peer to the client
+	peer.Write([]byte("pong"))
+	if _, err := io.ReadFull(client, out[:4]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out[:4], []byte("pong")) {
+		t.Fatalf("bad: %v", out[:4])
+	}
+}
+
+func TestRequest_Bind_AdvertisePort(t *testing.T) {
+	var listening *net.TCPAddr
+	s := &Server{config: &Config{
+		Rules:       PermitAll(),
+		BindTimeout: 10 * time.Millisecond,
+		BindAdvertisePort: func(local net.Addr) (net.IP, int) {
+			listening = local.(*net.TCPAddr)
+			return net.IPv4(203, 0, 113, 7), 40000
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	buf := bytes.NewBuffer([]byte{5, BindCommand, 0, 1, 127, 0, 0, 1, 0, 0})
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := &MockConn{}
+	s.handleRequest(req, resp)
+
+	// The first reply advertises the remapped address
+	out := resp.buf.Bytes()
+	expected := []byte{5, SuccessReply, 0, Ipv4Address, 203, 0, 113, 7, 40000 >> 8, 40000 & 0xff}
+	if len(out) < 10 || !bytes.Equal(out[:10], expected) {
+		t.Fatalf("bad: %v", out)
+	}
+	if listening == nil || listening.Port == 40000 {
+		t.Fatalf("bad: %v", listening)
+	}
+}
+
+func TestRequest_Bind_Timeout(t *testing.T) {
+	// Make server
+	s := &Server{config: &Config{
+		Rules:       PermitAll(),
+		BindTimeout: 200 * time.Millisecond,
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	// Create the bind request, expecting a peer we never connect from
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, BindCommand, 0, 1, 127, 0, 0, 2, 0, 0})
+
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.handleRequest(req, server) }()
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	out := make([]byte, 10)
+	if _, err := io.ReadFull(client, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	bindPort := binary.BigEndian.Uint16(out[8:])
+
+	// An unexpected peer is rejected
+	peer, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(bindPort))))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer peer.Close()
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(out); err != io.EOF {
+		t.Fatalf("expected rejected peer: %v", err)
+	}
+
+	// Then the bind times out
+	if _, err := io.ReadFull(client, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, []byte{5, TtlExpired, 0, 1, 0, 0, 0, 0, 0, 0}) {
+		t.Fatalf("bad: %v", out)
+	}
+	if err := <-errCh; err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestAddrSpec_MarshalBinary(t *testing.T) {
+	addrs := []*AddrSpec{
+		{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 80},
+		{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		{FQDN: "example.com", Port: 8080},
+	}
+	encoded := [][]byte{
+		{Ipv4Address, 10, 0, 0, 1, 0, 80},
+		{Ipv6Address, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 187},
+		append(append([]byte{FqdnAddress, 11}, "example.com"...), 0x1f, 0x90),
+	}
+
+	for i, addr := range addrs {
+		data, err := addr.MarshalBinary()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Equal(data, encoded[i]) {
+			t.Fatalf("bad: %v %v", data, encoded[i])
+		}
+
+		var out AddrSpec
+		if err := out.UnmarshalBinary(data); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out.FQDN != addr.FQDN || !out.IP.Equal(addr.IP) || out.Port != addr.Port {
+			t.Fatalf("bad: %v %v", out, addr)
+		}
+	}
+
+	var out AddrSpec
+	if err := out.UnmarshalBinary(append(encoded[0], 0)); err == nil {
+		t.Fatalf("expected error on trailing data")
+	}
+	if err := out.UnmarshalBinary([]byte{Ipv4Address, 10, 0}); err == nil {
+		t.Fatalf("expected error on short data")
+	}
+}
+
+func TestReadAddrSpecV5_SendReply(t *testing.T) {
+	addrs := []*AddrSpec{
+		{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 80},
+		{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		{FQDN: "example.com", Port: 8080},
+	}
+
+	for _, addr := range addrs {
+		var buf bytes.Buffer
+		if err := sendReply(&buf, SuccessReply, addr, socks5Version); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		header := buf.Next(3)
+		if !bytes.Equal(header, []byte{socks5Version, SuccessReply, 0}) {
+			t.Fatalf("bad: %v", header)
+		}
+
+		out, err := readAddrSpecV5(&buf, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out.FQDN != addr.FQDN || !out.IP.Equal(addr.IP) || out.Port != addr.Port {
+			t.Fatalf("bad: %v %v", out, addr)
+		}
+		if out.Address() != addr.Address() {
+			t.Fatalf("bad: %v %v", out.Address(), addr.Address())
+		}
+	}
+}
+
+func TestRequest_Associate_AdvertiseHost(t *testing.T) {
+	// Make server
+	s := &Server{config: &Config{
+		Rules:         PermitAll(),
+		AdvertiseHost: "proxy.example",
+		Logger:        log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	// Create the associate request
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, AssociateCommand, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	// Handle the request
+	resp := &MockConn{}
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := s.handleRequest(req, resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Verify response, ignoring the port
+	out := resp.buf.Bytes()
+	expected := append([]byte{5, SuccessReply, 0, FqdnAddress, 13}, "proxy.example"...)
+	if len(out) != len(expected)+2 || !bytes.Equal(out[:len(expected)], expected) {
+		t.Fatalf("bad: %v %v", out, expected)
+	}
+}
+
+func TestRequest_SOCKS4_Commands(t *testing.T) {
+	// Make server
+	s := &Server{config: &Config{
+		Rules:       PermitAll(),
+		BindTimeout: 10 * time.Millisecond,
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	// BIND is routed to the bind handler, which replies once listening
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{BindCommand, 0, 0, 127, 0, 0, 1, 0})
+
+	resp := &MockConn{}
+	req, err := NewRequest(buf, socks4Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s.handleRequest(req, resp)
+
+	out := resp.buf.Bytes()
+	if len(out) < 8 || out[1] != 0x5a {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Anything else is rejected with CD=91
+	for _, cmd := range []uint8{AssociateCommand, 9} {
+		buf := bytes.NewBuffer(nil)
+		buf.Write([]byte{cmd, 0, 80, 127, 0, 0, 1, 0})
+
+		resp := &MockConn{}
+		req, err := NewRequest(buf, socks4Version)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := s.handleRequest(req, resp); err == nil || !strings.Contains(err.Error(), "unsupported command") {
+			t.Fatalf("err: %v", err)
+		}
+
+		out := resp.buf.Bytes()
+		if !bytes.Equal(out, []byte{0, 0x5b, 0, 0, 0, 0, 0, 0}) {
+			t.Fatalf("bad: %v", out)
+		}
+	}
+}
+
+func TestRequest_SOCKS4_ConnectReplyAddr(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+
+	s := &Server{config: &Config{
+		Rules:    PermitAll(),
+		Resolver: staticResolver(net.IPv4(127, 0, 0, 1)),
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	// SOCKS4 with an IP, then SOCKS4a with a hostname
+	for _, addr := range [][]byte{{127, 0, 0, 1, 0}, append([]byte{0, 0, 0, 1, 0}, "localhost\x00"...)} {
+		buf := bytes.NewBuffer([]byte{ConnectCommand})
+		binary.Write(buf, binary.BigEndian, port)
+		buf.Write(addr)
+
+		resp := &MockConn{}
+		req, err := NewRequest(buf, socks4Version)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := s.handleRequest(req, resp); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// The destination is echoed, with the resolved IP
+		expected := []byte{0, 0x5a, byte(port >> 8), byte(port), 127, 0, 0, 1}
+		if out := resp.buf.Bytes(); !bytes.Equal(out, expected) {
+			t.Fatalf("bad: %v %v", out, expected)
+		}
+	}
+}
+
+func TestRequest_CommandHandlers(t *testing.T) {
+	// Make server, with a custom CONNECT handler
+	s := &Server{config: &Config{
+		Rules:  PermitAll(),
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+		CommandHandlers: map[uint8]func(ctx context.Context, conn net.Conn, req *Request) error{
+			ConnectCommand: func(ctx context.Context, conn net.Conn, req *Request) error {
+				if req.DestAddr.Port != 80 {
+					t.Fatalf("bad: %v", req.DestAddr)
+				}
+				if err := SendReply(ctx, conn, SuccessReply, req.DestAddr, req.Version); err != nil {
+					return err
+				}
+				data := make([]byte, 4)
+				if _, err := io.ReadFull(req.Reader(), data); err != nil {
+					return err
+				}
+				_, err := conn.Write(data)
+				return err
+			},
+		},
+	}}
+
+	// Create the connect request
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 80})
+	buf.Write([]byte("ping"))
+
+	// Handle the request
+	resp := &MockConn{}
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := s.handleRequest(req, resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Verify response
+	out := resp.buf.Bytes()
+	expected := []byte{
+		5,
+		0,
+		0,
+		1,
+		10, 0, 0, 1,
+		0, 80,
+		'p', 'i', 'n', 'g',
+	}
+
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v %v", out, expected)
+	}
+}
+
+func TestRequest_CommandHandlers_ReplyVersion(t *testing.T) {
+	s := &Server{config: &Config{
+		Rules:  PermitAll(),
+		Logger: log.New(io.Discard, "", 0),
+		CommandHandlers: map[uint8]func(ctx context.Context, conn net.Conn, req *Request) error{
+			ConnectCommand: func(ctx context.Context, conn net.Conn, req *Request) error {
+				return SendReply(ctx, conn, RuleFailure, nil, req.Version)
+			},
+		},
+	}}
+
+	// Handlers reply like the server, with ReplyVersion applied
+	req, err := NewRequest(bytes.NewBuffer([]byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 80}), socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := &MockConn{}
+	if err := s.handleRequest(req, resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out := resp.buf.Bytes(); !bytes.Equal(out, []byte{5, RuleFailure, 0, 1, 0, 0, 0, 0, 0, 0}) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	s.config.ReplyVersion = 1
+	req, err = NewRequest(bytes.NewBuffer([]byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 80}), socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = &MockConn{}
+	if err := s.handleRequest(req, resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out := resp.buf.Bytes(); !bytes.Equal(out, []byte{1, RuleFailure, 0, 1, 0, 0, 0, 0, 0, 0}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestRequest_Resolve(t *testing.T) {
+	s := &Server{config: &Config{
+		Rules:                  PermitNone(),
+		EnableResolveExtension: true,
+		Resolver:               staticResolver(net.ParseIP("10.1.2.3")),
+		Logger:                 log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	resolve := func() []byte {
+		buf := bytes.NewBuffer(nil)
+		buf.Write([]byte{5, ResolveCommand, 0, 3, 11})
+		buf.Write([]byte("example.com"))
+		buf.Write([]byte{0, 0})
+		req, err := NewRequest(buf, socks5Version)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := &MockConn{}
+		s.handleRequest(req, resp)
+		return resp.buf.Bytes()
+	}
+
+	// The reply carries the resolved IP
+	out := resolve()
+	expected := []byte{5, 0, 0, 1, 10, 1, 2, 3, 0, 0}
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v %v", out, expected)
+	}
+
+	// The command is unknown without the extension
+	s.config.EnableResolveExtension = false
+	out = resolve()
+	if len(out) < 2 || out[1] != CommandNotSupported {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestRequest_Resolve_NoResolver(t *testing.T) {
+	// Through New, and on a server without any Resolver at all
+	s, err := New(&Config{EnableResolveExtension: true, Logger: log.New(os.Stdout, "", log.LstdFlags)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	bare := &Server{config: &Config{EnableResolveExtension: true, Logger: log.New(os.Stdout, "", log.LstdFlags)}}
+
+	for _, s := range []*Server{s, bare} {
+		buf := bytes.NewBuffer(nil)
+		buf.Write([]byte{5, ResolveCommand, 0, 3, 9})
+		buf.Write([]byte("localhost"))
+		buf.Write([]byte{0, 0})
+		req, err := NewRequest(buf, socks5Version)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := &MockConn{}
+		if err := s.handleRequest(req, resp); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		out := resp.buf.Bytes()
+		expected := []byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0}
+		if !bytes.Equal(out, expected) {
+			t.Fatalf("bad: %v %v", out, expected)
+		}
+	}
+}
+
+func TestRequest_DisabledCommands(t *testing.T) {
+	// Make server
+	s := &Server{config: &Config{
+		Rules:            PermitAll(),
+		DisableBind:      true,
+		DisableAssociate: true,
+		Logger:           log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	for _, cmd := range []uint8{BindCommand, AssociateCommand} {
+		buf := bytes.NewBuffer(nil)
+		buf.Write([]byte{5, cmd, 0, 1, 127, 0, 0, 1, 0, 0})
+
+		resp := &MockConn{}
+		req, err := NewRequest(buf, socks5Version)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := s.handleRequest(req, resp); err == nil || !strings.Contains(err.Error(), "disabled") {
+			t.Fatalf("err: %v", err)
+		}
+
+		out := resp.buf.Bytes()
+		expected := []byte{5, CommandNotSupported, 0, 1, 0, 0, 0, 0, 0, 0}
+		if !bytes.Equal(out, expected) {
+			t.Fatalf("bad: %v %v", out, expected)
+		}
+	}
+}
+
+// countingConn counts the bytes read from and written to a net.Conn
+type countingConn struct {
+	net.Conn
+	read, written int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func TestRequest_Connect_OnDial(t *testing.T) {
+	// Create a local listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		conn, _ := l.Accept()
+		defer conn.Close()
+
+		buf := make([]byte, 4)
+		io.ReadAtLeast(conn, buf, 4)
+		conn.Write([]byte("pong!"))
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	// Make server
+	var counting *countingConn
+	s := &Server{config: &Config{
+		Rules:  PermitAll(),
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+		OnDial: func(req *Request, conn net.Conn) (net.Conn, error) {
+			counting = &countingConn{Conn: conn}
+			return counting, nil
+		},
+	}}
+
+	// Create the connect request
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1})
+	binary.Write(buf, binary.BigEndian, uint16(lAddr.Port))
+	buf.Write([]byte("ping"))
+
+	// Handle the request
+	resp := &MockConn{}
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.handleRequest(req, resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if counting.written != 4 || counting.read != 5 {
+		t.Fatalf("bad counts: written %d read %d", counting.written, counting.read)
+	}
+}
+
+func TestRequest_Connect_Intercept(t *testing.T) {
+	// Serve the destination in-process
+	local, remote := net.Pipe()
+	go func() {
+		defer remote.Close()
+		buf := make([]byte, 4)
+		io.ReadFull(remote, buf)
+		remote.Write([]byte("pong!"))
+	}()
+
+	var intercepted *AddrSpec
+	s := &Server{config: &Config{
+		Rules:  PermitAll(),
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, fmt.Errorf("unexpected dial")
+		},
+		Intercept: func(req *Request) (bool, net.Conn, error) {
+			intercepted = req.DestAddr
+			return true, local, nil
+		},
+	}}
+
+	// Create the connect request
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 3, 13})
+	buf.Write([]byte("service.local"))
+	buf.Write([]byte{0, 80})
+	buf.Write([]byte("ping"))
+
+	// Handle the request
+	resp := &MockConn{}
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.handleRequest(req, resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if intercepted == nil || intercepted.FQDN != "service.local" {
+		t.Fatalf("bad: %v", intercepted)
+	}
+
+	// Verify response
+	out := resp.buf.Bytes()
+	expected := []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	expected = append(expected, []byte("pong!")...)
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v %v", out, expected)
+	}
+}
+
+func TestRequest_Connect_DialRetries(t *testing.T) {
+	// Create a local listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	// The first dial fails with a transient error, or a permanent one
+	for _, tc := range []struct {
+		err   error
+		dials int
+		reply uint8
+	}{
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, 2, SuccessReply},
+		{&net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}, 1, HostUnreachable},
+	} {
+		dials := 0
+		s := &Server{config: &Config{
+			Rules:            PermitAll(),
+			DialRetries:      2,
+			DialRetryBackoff: time.Millisecond,
+			Logger:           log.New(os.Stdout, "", log.LstdFlags),
+			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dials++
+				if dials == 1 {
+					return nil, tc.err
+				}
+				return net.Dial(network, addr)
+			},
+		}}
+
+		buf := bytes.NewBuffer(nil)
+		buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1})
+		binary.Write(buf, binary.BigEndian, uint16(lAddr.Port))
+		req, err := NewRequest(buf, socks5Version)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := &MockConn{}
+		s.handleRequest(req, resp)
+
+		out := resp.buf.Bytes()
+		if dials != tc.dials || len(out) < 2 || out[1] != tc.reply {
+			t.Fatalf("bad: %d %v", dials, out)
+		}
+	}
+}
+
+func TestRequest_Connect_OnDialError(t *testing.T) {
+	// Create a local listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	// Make server
+	s := &Server{config: &Config{
+		Rules:  PermitAll(),
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+		OnDial: func(req *Request, conn net.Conn) (net.Conn, error) {
+			return nil, fmt.Errorf("not today")
+		},
+	}}
+
+	// Create the connect request
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1})
+	binary.Write(buf, binary.BigEndian, uint16(lAddr.Port))
+
+	// Handle the request
+	resp := &MockConn{}
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.handleRequest(req, resp); err == nil || !strings.Contains(err.Error(), "not today") {
+		t.Fatalf("err: %v", err)
+	}
+
+	out := resp.buf.Bytes()
+	expected := []byte{5, ServerFailure, 0, 1, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v %v", out, expected)
+	}
+}
+
+func TestRequest_Connect_EarlyData(t *testing.T) {
+	// Create a local listener, which only replies once it got the ping
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 4)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		io.ReadFull(conn, buf)
+		received <- buf
+		if bytes.Equal(buf, []byte("ping")) {
+			conn.Write([]byte("pong"))
+		}
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	// Make server
+	s := &Server{config: &Config{
+		Rules:  PermitAll(),
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	// The ping is sent along with the request, before any reply
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1})
+	binary.Write(buf, binary.BigEndian, uint16(lAddr.Port))
+	buf.Write([]byte("ping"))
+
+	resp := &MockConn{}
+	req, err := NewRequest(bufio.NewReader(buf), socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.handleRequest(req, resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if got := <-received; !bytes.Equal(got, []byte("ping")) {
+		t.Fatalf("bad: %v", got)
+	}
+	out := resp.buf.Bytes()
+	if !bytes.HasSuffix(out, []byte("pong")) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestRequest_Connect_ZeroPort(t *testing.T) {
+	// Make server
+	var dialed bool
+	s := &Server{config: &Config{
+		Rules:  PermitAll(),
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = true
+			return nil, fmt.Errorf("unexpected dial")
+		},
+	}}
+
+	// Create the connect request
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 0})
+
+	// Handle the request
+	resp := &MockConn{}
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.handleRequest(req, resp); err == nil || !strings.Contains(err.Error(), "port 0") {
+		t.Fatalf("err: %v", err)
+	}
+	if dialed {
+		t.Fatalf("unexpected dial")
+	}
+
+	out := resp.buf.Bytes()
+	expected := []byte{5, ServerFailure, 0, 1, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v %v", out, expected)
+	}
+}
+
+func TestRequest_BindAssociate_Rules(t *testing.T) {
+	// Make server
+	s := &Server{config: &Config{
+		Rules:  PermitNone(),
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	for _, cmd := range []uint8{BindCommand, AssociateCommand} {
+		buf := bytes.NewBuffer(nil)
+		buf.Write([]byte{5, cmd, 0, 1, 127, 0, 0, 1, 0, 80})
+
+		resp := &MockConn{}
+		req, err := NewRequest(buf, socks5Version)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := s.handleRequest(req, resp); err == nil || !strings.Contains(err.Error(), "blocked by rules") {
+			t.Fatalf("err: %v", err)
+		}
+
+		out := resp.buf.Bytes()
+		expected := []byte{5, RuleFailure, 0, 1, 0, 0, 0, 0, 0, 0}
+		if !bytes.Equal(out, expected) {
+			t.Fatalf("bad: %v %v", out, expected)
+		}
+	}
+
+	// SOCKS4 BIND gets a SOCKS4 rejection
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{BindCommand, 0, 80, 127, 0, 0, 1, 0})
+
+	resp := &MockConn{}
+	req, err := NewRequest(buf, socks4Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.handleRequest(req, resp); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	out := resp.buf.Bytes()
+	expected := []byte{0, 91, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v %v", out, expected)
+	}
+}
+
+func TestRequest_Connect_DefaultIPv6Zone(t *testing.T) {
+	var dialed []string
+	s := &Server{config: &Config{
+		Rules:           PermitAll(),
+		DefaultIPv6Zone: "eth0",
+		Logger:          log.New(os.Stdout, "", log.LstdFlags),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return nil, fmt.Errorf("unreachable")
+		},
+	}}
+
+	for _, ip := range []string{"fe80::1", "2001:db8::1"} {
+		buf := bytes.NewBuffer(nil)
+		buf.Write([]byte{5, 1, 0, 4})
+		buf.Write(net.ParseIP(ip))
+		buf.Write([]byte{0, 80})
+
+		req, err := NewRequest(buf, socks5Version)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		s.handleRequest(req, &MockConn{})
+
+		// The zone is not visible to the client
+		if req.DestAddr.Zone != "" {
+			t.Fatalf("bad: %v", req.DestAddr)
+		}
+	}
+
+	// Only link-local destinations are scoped
+	expected := []string{"[fe80::1%eth0]:80", "[2001:db8::1]:80"}
+	if !reflect.DeepEqual(dialed, expected) {
+		t.Fatalf("bad: %v", dialed)
+	}
+}
+
+func TestRequest_ReplyError(t *testing.T) {
+	s := &Server{config: &Config{
+		Rules:  &PermitCommand{EnableConnect: true},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	for _, msg := range [][]byte{
+		{5, ConnectCommand, 0, 1, 127, 0, 0, 1, 0, 0},
+		{5, BindCommand, 0, 1, 127, 0, 0, 1, 0, 80},
+		{5, 9, 0, 1, 127, 0, 0, 1, 0, 80},
+	} {
+		req, err := NewRequest(bytes.NewBuffer(msg), socks5Version)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := &MockConn{}
+		err = s.handleRequest(req, resp)
+
+		// The code is reachable through wrapping
+		var replyErr *ReplyError
+		if !errors.As(fmt.Errorf("wrapped: %w", err), &replyErr) {
+			t.Fatalf("err: %v", err)
+		}
+		out := resp.buf.Bytes()
+		if len(out) < 2 || replyErr.Code != out[1] || replyErr.Code == SuccessReply {
+			t.Fatalf("bad: %v %v", replyErr.Code, out)
+		}
+	}
+}
+
+func TestRequest_Connect_EgressAllow(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	var dialed []string
+	s := &Server{config: &Config{
+		Rules:       PermitAll(),
+		Resolver:    staticResolver(net.IPv4(10, 0, 0, 1)),
+		EgressAllow: []*net.IPNet{loopback},
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return nil, fmt.Errorf("unreachable")
+		},
+	}}
+
+	// An FQDN resolving outside the allowlist is refused
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 3, 11})
+	buf.Write([]byte("example.com"))
+	buf.Write([]byte{0, 80})
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := &MockConn{}
+	if err := s.handleRequest(req, resp); err == nil || !strings.Contains(err.Error(), "egress allowlist") {
+		t.Fatalf("err: %v", err)
+	}
+	out := resp.buf.Bytes()
+	expected := []byte{5, RuleFailure, 0, 1, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v %v", out, expected)
+	}
+	if len(dialed) != 0 {
+		t.Fatalf("unexpected dial: %v", dialed)
+	}
+
+	// An IP literal inside the allowlist is dialed
+	buf = bytes.NewBuffer([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	req, err = NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s.handleRequest(req, &MockConn{})
+	if len(dialed) != 1 || dialed[0] != "127.0.0.1:80" {
+		t.Fatalf("bad: %v", dialed)
+	}
+}
+
+func TestRequest_Connect_EgressAllow_Unresolved(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	var dialed []string
+	s := &Server{config: &Config{
+		Rules:       PermitAll(),
+		EgressAllow: []*net.IPNet{loopback},
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return nil, fmt.Errorf("unreachable")
+		},
+	}}
+
+	// Without a Resolver the hostname is looked up for the check, but
+	// dialed as is
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 3, 9})
+	buf.Write([]byte("localhost"))
+	buf.Write([]byte{0, 80})
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s.handleRequest(req, &MockConn{})
+	if !reflect.DeepEqual(dialed, []string{"localhost:80"}) {
+		t.Fatalf("bad: %v", dialed)
+	}
+}
+
+func TestSOCKS5_EgressAllow_FQDN(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	echoAddr := startEchoServer(t)
+	proxyAddr := startServer(t, &Config{
+		EgressAllow: []*net.IPNet{loopback},
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	// A hostname resolving inside the allowlist is reachable
+	conn, err := Dial("tcp", proxyAddr, localhostAddr(echoAddr), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+	conn.Close()
+}
+
+// metadataRule allows any FQDN, and IPs outside the link-local range
+type metadataRule struct{}
+
+func (metadataRule) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	if req.DestAddr.FQDN != "" {
+		return ctx, true
+	}
+	return ctx, !req.DestAddr.IP.IsLinkLocalUnicast()
+}
+
+func TestRequest_Connect_ReCheckResolvedIP(t *testing.T) {
+	for _, recheck := range []bool{false, true} {
+		var dialed []string
+		s := &Server{config: &Config{
+			Rules:             metadataRule{},
+			Resolver:          staticResolver(net.IPv4(169, 254, 169, 254)),
+			ReCheckResolvedIP: recheck,
+			Logger:            log.New(os.Stdout, "", log.LstdFlags),
+			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dialed = append(dialed, addr)
+				return nil, fmt.Errorf("unreachable")
+			},
+		}}
+
+		buf := bytes.NewBuffer(nil)
+		buf.Write([]byte{5, 1, 0, 3, 11})
+		buf.Write([]byte("example.com"))
+		buf.Write([]byte{0, 80})
+		req, err := NewRequest(buf, socks5Version)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := &MockConn{}
+		s.handleRequest(req, resp)
+
+		if !recheck {
+			if len(dialed) != 1 {
+				t.Fatalf("bad: %v", dialed)
+			}
+			continue
+		}
+		if len(dialed) != 0 {
+			t.Fatalf("unexpected dial: %v", dialed)
+		}
+		out := resp.buf.Bytes()
+		expected := []byte{5, RuleFailure, 0, 1, 0, 0, 0, 0, 0, 0}
+		if !bytes.Equal(out, expected) {
+			t.Fatalf("bad: %v %v", out, expected)
+		}
+	}
+}
+
+func TestRequest_Connect_ReCheckResolvedIP_Unresolved(t *testing.T) {
+	var dialed []string
+	s := &Server{config: &Config{
+		Rules: ruleFunc(func(ctx context.Context, req *Request) (context.Context, bool) {
+			return ctx, req.DestAddr.FQDN != "" || !req.DestAddr.IP.IsLoopback()
+		}),
+		ReCheckResolvedIP: true,
+		Logger:            log.New(os.Stdout, "", log.LstdFlags),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return nil, fmt.Errorf("unreachable")
+		},
+	}}
+
+	// Without a Resolver the hostname is looked up for the check
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 3, 9})
+	buf.Write([]byte("localhost"))
+	buf.Write([]byte{0, 80})
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.handleRequest(req, &MockConn{}); err == nil || !strings.Contains(err.Error(), "resolved address") {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dialed) != 0 {
+		t.Fatalf("unexpected dial: %v", dialed)
+	}
+}
+
+func TestSOCKS5_ReCheckResolvedIP_NoResolver(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	proxyAddr := startServer(t, &Config{
+		ReCheckResolvedIP: true,
+		Logger:            log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	conn, err := Dial("tcp", proxyAddr, localhostAddr(echoAddr), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+	conn.Close()
+}
+
+func TestRequest_Connect_BlockPrivateDestinations(t *testing.T) {
+	_, internal, _ := net.ParseCIDR("10.1.0.0/16")
+	var dialed []string
+	s := &Server{config: &Config{
+		Rules:                    PermitAll(),
+		BlockPrivateDestinations: true,
+		PrivateDestinationsAllow: []*net.IPNet{internal},
+		Logger:                   log.New(os.Stdout, "", log.LstdFlags),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return nil, fmt.Errorf("unreachable")
+		},
+	}}
+
+	connect := func(ip string) []byte {
+		buf := bytes.NewBuffer(nil)
+		if v4 := net.ParseIP(ip).To4(); v4 != nil {
+			buf.Write([]byte{5, 1, 0, 1})
+			buf.Write(v4)
+		} else {
+			buf.Write([]byte{5, 1, 0, 4})
+			buf.Write(net.ParseIP(ip))
+		}
+		buf.Write([]byte{0, 80})
+		req, err := NewRequest(buf, socks5Version)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := &MockConn{}
+		s.handleRequest(req, resp)
+		return resp.buf.Bytes()
+	}
+
+	for _, ip := range []string{"127.0.0.1", "10.0.0.1", "169.254.169.254", "::1", "fd00::1", "0.0.0.0"} {
+		out := connect(ip)
+		if len(out) < 2 || out[1] != RuleFailure {
+			t.Fatalf("bad: %v %v", ip, out)
+		}
+	}
+	if len(dialed) != 0 {
+		t.Fatalf("unexpected dial: %v", dialed)
+	}
+
+	// Public and explicitly allowed destinations are dialed
+	for _, ip := range []string{"8.8.8.8", "10.1.2.3"} {
+		connect(ip)
+	}
+	if !reflect.DeepEqual(dialed, []string{"8.8.8.8:80", "10.1.2.3:80"}) {
+		t.Fatalf("bad: %v", dialed)
+	}
+}
+
+func TestRequest_Connect_BlockPrivateDestinations_Unresolved(t *testing.T) {
+	var dialed []string
+	s := &Server{config: &Config{
+		Rules:                    PermitAll(),
+		BlockPrivateDestinations: true,
+		Logger:                   log.New(os.Stdout, "", log.LstdFlags),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return nil, fmt.Errorf("unreachable")
+		},
+	}}
+
+	// Without a Resolver the hostname is looked up for the check
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 3, 9})
+	buf.Write([]byte("localhost"))
+	buf.Write([]byte{0, 80})
+	raw := buf.Bytes()
+	req, err := NewRequest(bytes.NewBuffer(raw), socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.handleRequest(req, &MockConn{}); err == nil || !strings.Contains(err.Error(), "private destination") {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dialed) != 0 {
+		t.Fatalf("unexpected dial: %v", dialed)
+	}
+
+	// And dialed by name once its IP is allowed
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	s.config.PrivateDestinationsAllow = []*net.IPNet{loopback}
+	req, err = NewRequest(bytes.NewBuffer(raw), socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s.handleRequest(req, &MockConn{})
+	if !reflect.DeepEqual(dialed, []string{"localhost:80"}) {
+		t.Fatalf("bad: %v", dialed)
+	}
+}
+
+func TestSOCKS5_BlockPrivateDestinations_FQDN(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	echoAddr := startEchoServer(t)
+	proxyAddr := startServer(t, &Config{
+		BlockPrivateDestinations: true,
+		Logger:                   log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	// A hostname resolving to a private IP is refused
+	_, err := Dial("tcp", proxyAddr, localhostAddr(echoAddr), nil)
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code != RuleFailure {
+		t.Fatalf("err: %v", err)
+	}
+
+	// And reachable once its IP is allowed
+	proxyAddr = startServer(t, &Config{
+		BlockPrivateDestinations: true,
+		PrivateDestinationsAllow: []*net.IPNet{loopback},
+		Logger:                   log.New(os.Stdout, "", log.LstdFlags),
+	})
+	conn, err := Dial("tcp", proxyAddr, localhostAddr(echoAddr), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+	conn.Close()
+}
+
+func TestRequest_Connect_NoResolver(t *testing.T) {
+	var dialed []string
+	var allowed net.IP
+	s, err := New(&Config{
+		BlockCloudMetadata: true,
+		AllowDial: func(ctx context.Context, req *Request, ip net.IP, port int) error {
+			allowed = ip
+			return nil
+		},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return nil, fmt.Errorf("unreachable")
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if s.config.Resolver != nil {
+		t.Fatalf("bad: %v", s.config.Resolver)
+	}
+
+	// The hostname is checked on its IP, but left for the dialer
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 3, 9})
+	buf.Write([]byte("localhost"))
+	buf.Write([]byte{0, 80})
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s.handleRequest(req, &MockConn{})
+	if !reflect.DeepEqual(dialed, []string{"localhost:80"}) {
+		t.Fatalf("bad: %v", dialed)
+	}
+	if !allowed.IsLoopback() {
+		t.Fatalf("bad: %v", allowed)
+	}
+	if req.Resolved || req.DestAddr.IP != nil {
+		t.Fatalf("bad: %v %v", req.Resolved, req.DestAddr)
+	}
+}
+
+func TestRequest_Connect_BlockCloudMetadata(t *testing.T) {
+	var dialed []string
+	s := &Server{config: &Config{
+		Rules:              PermitAll(),
+		BlockCloudMetadata: true,
+		Resolver:           staticResolver(net.ParseIP("169.254.169.254")),
+		Logger:             log.New(os.Stdout, "", log.LstdFlags),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return nil, fmt.Errorf("unreachable")
+		},
+	}}
+
+	connect := func(raw []byte) []byte {
+		buf := bytes.NewBuffer(raw)
+		req, err := NewRequest(buf, socks5Version)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := &MockConn{}
+		s.handleRequest(req, resp)
+		return resp.buf.Bytes()
+	}
+
+	v6 := append([]byte{5, 1, 0, 4}, net.ParseIP("fd00:ec2::254")...)
+	for _, raw := range [][]byte{
+		{5, 1, 0, 1, 169, 254, 169, 254, 0, 80},
+		append(v6, 0, 80),
+		append([]byte{5, 1, 0, 3, 8}, append([]byte("metadata"), 0, 80)...),
+	} {
+		out := connect(raw)
+		if len(out) < 2 || out[1] != RuleFailure {
+			t.Fatalf("bad: %v %v", raw, out)
+		}
+	}
+	if len(dialed) != 0 {
+		t.Fatalf("unexpected dial: %v", dialed)
+	}
+
+	// Other link-local and private destinations are still dialed
+	connect([]byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 80})
+	if !reflect.DeepEqual(dialed, []string{"10.0.0.1:80"}) {
+		t.Fatalf("bad: %v", dialed)
+	}
+}
+
+func TestRequest_Connect_AllowDial(t *testing.T) {
+	errBlocked := fmt.Errorf("blocked ip")
+	var dialed []string
+	var checked []string
+	s := &Server{config: &Config{
+		Rules:    PermitAll(),
+		Resolver: staticResolver(net.ParseIP("10.0.0.1")),
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+		AllowDial: func(ctx context.Context, req *Request, ip net.IP, port int) error {
+			checked = append(checked, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+			if ip.Equal(net.ParseIP("10.0.0.1")) {
+				return errBlocked
+			}
+			return nil
+		},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return nil, fmt.Errorf("unreachable")
+		},
+	}}
+
+	connect := func(raw []byte) ([]byte, error) {
+		req, err := NewRequest(bytes.NewBuffer(raw), socks5Version)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := &MockConn{}
+		err = s.handleRequest(req, resp)
+		return resp.buf.Bytes(), err
+	}
+
+	// The callback sees the resolved IP of FQDN destinations
+	out, err := connect([]byte{5, 1, 0, 3, 7, 'b', 'l', 'o', 'c', 'k', 'e', 'd', 0, 80})
+	if len(out) < 2 || out[1] != RuleFailure {
+		t.Fatalf("bad: %v", out)
+	}
+	if !errors.Is(err, errBlocked) {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dialed) != 0 {
+		t.Fatalf("unexpected dial: %v", dialed)
+	}
+
+	// Other addresses are dialed
+	connect([]byte{5, 1, 0, 1, 10, 0, 0, 2, 0, 81})
+	if !reflect.DeepEqual(dialed, []string{"10.0.0.2:81"}) {
+		t.Fatalf("bad: %v", dialed)
+	}
+	if !reflect.DeepEqual(checked, []string{"10.0.0.1:80", "10.0.0.2:81"}) {
+		t.Fatalf("bad: %v", checked)
+	}
+}
+
+// localhostAddr returns addr with its host replaced by "localhost"
+func localhostAddr(addr string) string {
+	_, port, _ := net.SplitHostPort(addr)
+	return net.JoinHostPort("localhost", port)
+}
+
+func TestSOCKS5_BlockCloudMetadata_FQDN(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	proxyAddr := startServer(t, &Config{
+		BlockCloudMetadata: true,
+		Logger:             log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	// Hostnames are looked up for the check, and dialed as is
+	conn, err := Dial("tcp", proxyAddr, localhostAddr(echoAddr), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+	conn.Close()
+}
+
+func TestRequest_ReplyVersion(t *testing.T) {
+	// Make server
+	s := &Server{config: &Config{
+		Rules:  PermitNone(),
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	for _, version := range []uint8{0, 1} {
+		s.config.ReplyVersion = version
+
+		buf := bytes.NewBuffer(nil)
+		buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+
+		resp := &MockConn{}
+		req, err := NewRequest(buf, socks5Version)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		s.handleRequest(req, resp)
+
+		out := resp.buf.Bytes()
+		expected := []byte{version, RuleFailure, 0, 1, 0, 0, 0, 0, 0, 0}
+		if version == 0 {
+			expected[0] = socks5Version
+		}
+		if !bytes.Equal(out, expected) {
+			t.Fatalf("bad: %v %v", out, expected)
+		}
+	}
+}
+
+func TestNewRequest_SOCKS4a(t *testing.T) {
+	// SOCKS4a with an empty userid
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{ConnectCommand, 0, 80, 0, 0, 0, 1, 0})
+	buf.Write([]byte("example.com\x00"))
+
+	req, err := NewRequest(buf, socks4Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if req.AuthContext != nil {
+		t.Fatalf("unexpected auth context: %v", req.AuthContext)
+	}
+	if req.DestAddr.FQDN != "example.com" || req.DestAddr.IP != nil || req.DestAddr.Port != 80 {
+		t.Fatalf("bad: %v", req.DestAddr)
+	}
+	if req.DestAddr.Address() != "example.com:80" {
+		t.Fatalf("bad: %v", req.DestAddr.Address())
+	}
+
+	// Plain SOCKS4: 0.0.0.0 is not the SOCKS4a sentinel
+	buf = bytes.NewBuffer(nil)
+	buf.Write([]byte{ConnectCommand, 0, 80, 0, 0, 0, 0})
+	buf.Write([]byte("foo\x00"))
+
+	req, err = NewRequest(buf, socks4Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if req.DestAddr.FQDN != "" || req.AuthContext.Payload["Username"] != "foo" {
+		t.Fatalf("bad: %v %v", req.DestAddr, req.AuthContext)
+	}
+
+	// Truncated requests fail with a clear error
+	truncated := [][]byte{
+		{ConnectCommand, 0, 80, 0, 0, 0, 1},
+		{ConnectCommand, 0, 80, 0, 0, 0, 1, 'f', 'o'},
+		{ConnectCommand, 0, 80, 0, 0, 0, 1, 0},
+		{ConnectCommand, 0, 80, 0, 0, 0, 1, 0, 'e', 'x'},
+		{ConnectCommand, 0, 80, 0, 0, 0, 1, 0, 0},
+	}
+	for _, b := range truncated {
+		if _, err := NewRequest(bytes.NewBuffer(b), socks4Version); err == nil {
+			t.Fatalf("expected error for %v", b)
+		}
+	}
+
+	// Hostnames with whitespace or control characters are rejected
+	buf = bytes.NewBuffer(nil)
+	buf.Write([]byte{ConnectCommand, 0, 80, 0, 0, 0, 1, 0})
+	buf.Write([]byte("example.com\r\nX-Injected: 1\x00"))
+	if _, err := NewRequest(buf, socks4Version); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Oversized fields are rejected
+	buf = bytes.NewBuffer(nil)
+	buf.Write([]byte{ConnectCommand, 0, 80, 0, 0, 0, 1, 0})
+	buf.Write(bytes.Repeat([]byte{'a'}, 1000))
+	buf.Write([]byte{0})
+	if _, err := NewRequest(buf, socks4Version); err == nil || !strings.Contains(err.Error(), "longer") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestRequest_HostBlocklist(t *testing.T) {
+	// Make server
+	var resolved []string
+	s := &Server{config: &Config{
+		Rules:         PermitAll(),
+		HostBlocklist: []string{"bad.example", "*.evil.test"},
+		Logger:        log.New(os.Stdout, "", log.LstdFlags),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			resolved = append(resolved, addr)
+			return nil, fmt.Errorf("not dialing")
+		},
+	}}
+
+	request := func(host string) *Request {
+		buf := bytes.NewBuffer(nil)
+		buf.Write([]byte{5, 1, 0, 3, byte(len(host))})
+		buf.Write([]byte(host))
+		buf.Write([]byte{0, 80})
+		req, err := NewRequest(buf, socks5Version)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return req
+	}
+
+	for _, host := range []string{"bad.example", "BAD.example.", "www.evil.test", "a.b.evil.test"} {
+		resp := &MockConn{}
+		if err := s.handleRequest(request(host), resp); err == nil || !strings.Contains(err.Error(), "blocklist") {
+			t.Fatalf("err: %v", err)
+		}
+		out := resp.buf.Bytes()
+		expected := []byte{5, RuleFailure, 0, 1, 0, 0, 0, 0, 0, 0}
+		if !bytes.Equal(out, expected) {
+			t.Fatalf("bad: %v %v", out, expected)
+		}
+	}
+	if len(resolved) != 0 {
+		t.Fatalf("unexpected dial: %v", resolved)
+	}
+
+	for _, host := range []string{"good.example", "evil.test", "notevil.test", "bad.example.org"} {
+		if err := s.handleRequest(request(host), &MockConn{}); err == nil || strings.Contains(err.Error(), "blocklist") {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if len(resolved) != 4 {
+		t.Fatalf("bad: %v", resolved)
+	}
+}
+
+func TestRequest_FailureDelay(t *testing.T) {
+	s := &Server{config: &Config{
+		Rules:        PermitNone(),
+		FailureDelay: 5 * time.Second,
+		Logger:       log.New(os.Stdout, "", log.LstdFlags),
+	}}
+	clock := useFakeClock(s)
+
+	req, err := NewRequest(bytes.NewBuffer([]byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 80}), socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	client, conn := net.Pipe()
+	defer client.Close()
+	go s.handleRequest(req, conn)
+
+	// Nothing is sent till the delay is over
+	clock.BlockUntil(1)
+	clock.Advance(5*time.Second - time.Millisecond)
+	client.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	out := make([]byte, 10)
+	if _, err := client.Read(out); err == nil {
+		t.Fatalf("reply not delayed")
+	}
+
+	clock.Advance(time.Millisecond)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(client, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[1] != RuleFailure {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestRequest_FailureDelay_Shutdown(t *testing.T) {
+	s := &Server{config: &Config{
+		Rules:        PermitNone(),
+		FailureDelay: time.Hour,
+		Logger:       log.New(os.Stdout, "", log.LstdFlags),
+	}}
+	useFakeClock(s)
+
+	req, err := NewRequest(bytes.NewBuffer([]byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 80}), socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.handleRequest(req, &MockConn{}) }()
+
+	// A forced shutdown cancels the base context
+	s.baseContext()
+	s.mu.Lock()
+	s.cancelBase()
+	s.mu.Unlock()
+	select {
+	case <-errCh:
+	case <-time.After(time.Second):
+		t.Fatalf("delay not cut short")
+	}
+}
+
+func TestRequest_StrictRSV(t *testing.T) {
+	raw := []byte{5, 1, 7, 1, 127, 0, 0, 1, 0, 80}
+
+	// The reserved byte is ignored by default
+	req, err := NewRequest(bytes.NewBuffer(raw), socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if req.Command != ConnectCommand || req.DestAddr.Port != 80 {
+		t.Fatalf("bad: %v", req)
+	}
+
+	// In strict mode the request is rejected before reading the address
+	s, err := New(&Config{StrictRSV: true, Logger: log.New(os.Stdout, "", log.LstdFlags)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.ServeConn(newPipeConn(t, append([]byte{5, 1, NoAuth}, raw...))); !errors.Is(err, ErrNonZeroRSV) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A zero reserved byte is accepted
+	raw[2] = 0
+	if _, err := newRequest(bytes.NewBuffer(raw), socks5Version, s.config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestServeConn_ConnIDInErrors(t *testing.T) {
+	logs := &lockedBuffer{}
+	s, err := New(&Config{Logger: log.New(logs, "", 0)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	s.ServeConn(newPipeConn(t, []byte{5, 1, NoAuth, 5, 1, 0, Ipv4Address, 127, 0, 0, 1, 0, 0}))
+	err = s.ServeConn(newPipeConn(t, []byte{6, 1, 0}))
+	if err == nil || !strings.HasPrefix(err.Error(), "conn 2: ") {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.Contains(logs.String(), "[ERR] socks: conn 2: unsupported socks version") {
+		t.Fatalf("bad: %q", logs.String())
+	}
+}
+
+func TestRequest_ErrorWrapping(t *testing.T) {
+	s, err := New(&Config{Logger: log.New(os.Stdout, "", log.LstdFlags)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Unknown version
+	if err := s.ServeConn(newPipeConn(t, []byte{6, 1, 0})); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := NewRequest(bytes.NewBuffer([]byte{4, 1, 0}), socks5Version); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Unknown address type
+	if err := s.ServeConn(newPipeConn(t, []byte{5, 1, NoAuth, 5, 1, 0, 9})); !errors.Is(err, ErrUnrecognizedAddrType) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Unknown command
+	req, err := NewRequest(bytes.NewBuffer([]byte{5, 9, 0, 1, 127, 0, 0, 1, 0, 80}), socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.handleRequest(req, &MockConn{}); !errors.Is(err, ErrUnsupportedCommand) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The dial error is kept
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	lAddr := l.Addr().(*net.TCPAddr)
+	l.Close()
+	buf := bytes.NewBuffer([]byte{5, 1, 0, 1, 127, 0, 0, 1})
+	binary.Write(buf, binary.BigEndian, uint16(lAddr.Port))
+	req, err = NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err = s.handleRequest(req, &MockConn{})
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+// newPipeConn returns a connection from which the server reads data,
+// its replies being discarded
+func newPipeConn(t *testing.T, data []byte) net.Conn {
+	client, conn := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		client.Write(data)
+		io.Copy(io.Discard, client)
+	}()
+	return conn
+}
+
+func TestRequest_Connect_EarlyDataBeforeReply(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 5)
+		io.ReadFull(conn, buf)
+		received <- buf
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	s := &Server{config: &Config{
+		Rules:  PermitAll(),
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	// The request is followed by data the client sent right away
+	buf := bytes.NewBuffer([]byte{5, 1, 0, 1, 127, 0, 0, 1})
+	binary.Write(buf, binary.BigEndian, uint16(lAddr.Port))
+	buf.WriteString("GET /")
+	bufConn := bufio.NewReader(buf)
+	bufConn.Peek(1)
+	req, err := NewRequest(bufConn, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The reply can't be written until the client reads it
+	client, conn := net.Pipe()
+	defer client.Close()
+	go s.handleRequest(req, conn)
+
+	select {
+	case data := <-received:
+		if string(data) != "GET /" {
+			t.Fatalf("bad: %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("early data not forwarded before the reply")
+	}
+
+	out := make([]byte, 10)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(client, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[1] != SuccessReply {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestReplyCodeString(t *testing.T) {
+	codes := []struct {
+		code  uint8
+		value uint8
+		name  string
+	}{
+		{SuccessReply, 0, "succeeded"},
+		{ServerFailure, 1, "general SOCKS server failure"},
+		{RuleFailure, 2, "connection not allowed by ruleset"},
+		{NetworkUnreachable, 3, "network unreachable"},
+		{HostUnreachable, 4, "host unreachable"},
+		{ConnectionRefused, 5, "connection refused"},
+		{TtlExpired, 6, "TTL expired"},
+		{CommandNotSupported, 7, "command not supported"},
+		{AddrTypeNotSupported, 8, "address type not supported"},
+	}
+	for _, c := range codes {
+		if c.code != c.value {
+			t.Fatalf("bad: %v %v", c.code, c.value)
+		}
+		if out := ReplyCodeString(c.code); out != c.name {
+			t.Fatalf("bad: %v %v", c.code, out)
+		}
+	}
+	if out := ReplyCodeString(9); out != "unassigned reply code 9" {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += n
+	return n, err
+}
+
+func FuzzNewRequest(f *testing.F) {
+	f.Add(byte(socks5Version), []byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	f.Add(byte(socks5Version), []byte{5, 1, 0, 3, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0, 80})
+	f.Add(byte(socks5Version), append([]byte{5, 1, 0, 4}, make([]byte, 18)...))
+	f.Add(byte(socks4Version), []byte{1, 0, 80, 127, 0, 0, 1, 'u', 0})
+	f.Add(byte(socks4Version), []byte{1, 0, 80, 0, 0, 0, 1, 0, 'h', 'o', 's', 't', 0})
+
+	// The longest requests: a SOCKS5 FQDN one and a SOCKS4a one
+	maxLen := map[byte]int{
+		socks5Version: 4 + 1 + 255 + 2,
+		socks4Version: 1 + 2 + 4 + 2*(maxSocks4FieldLen+1),
+	}
+
+	f.Fuzz(func(t *testing.T, version byte, data []byte) {
+		if version != socks5Version && version != socks4Version {
+			return
+		}
+		r := &countingReader{r: bytes.NewReader(data)}
+		req, err := NewRequest(r, version)
+		if r.n > maxLen[version] {
+			t.Fatalf("read %d bytes", r.n)
+		}
+		if err == nil && (req.DestAddr == nil || (req.DestAddr.IP == nil && req.DestAddr.FQDN == "")) {
+			t.Fatalf("bad: %v", req)
+		}
+	})
+}
@@ -1,7 +1,10 @@
 package socks
 
 import (
+	"container/list"
 	"net"
+	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -11,6 +14,38 @@ type NameResolver interface {
 	Resolve(ctx context.Context, name string) (context.Context, net.IP, error)
 }
 
+type remoteAddrKey struct{}
+
+// RemoteAddrFromContext returns the address of the client that sent the
+// request being handled, if known. The context passed to NameResolver,
+// RuleSet and AddressRewriter carries it, allowing e.g. split-horizon
+// name resolution
+func RemoteAddrFromContext(ctx context.Context) (*AddrSpec, bool) {
+	addr, ok := ctx.Value(remoteAddrKey{}).(*AddrSpec)
+	return addr, ok
+}
+
+type connIDKey struct{}
+
+// ConnIDFromContext returns the ID of the connection the request being
+// handled came from. The context passed to the hooks, NameResolver,
+// RuleSet and AddressRewriter carries it
+func ConnIDFromContext(ctx context.Context) (uint64, bool) {
+	id, ok := ctx.Value(connIDKey{}).(uint64)
+	return id, ok
+}
+
+type resolvedIPKey struct{}
+
+// ResolvedIPFromContext returns the IP the FQDN destination of the
+// request being handled was resolved to by the server. The context
+// passed to RuleSet and AddressRewriter carries it, so that rules can
+// check the destination IP without another lookup
+func ResolvedIPFromContext(ctx context.Context) (net.IP, bool) {
+	ip, ok := ctx.Value(resolvedIPKey{}).(net.IP)
+	return ip, ok
+}
+
 // DNSResolver uses the system DNS to resolve host names
 type DNSResolver struct{}
 
@@ -21,3 +56,134 @@ func (d DNSResolver) Resolve(ctx context.Context, name string) (context.Context,
 	}
 	return ctx, addr.IP, err
 }
+
+const (
+	// defaultResolverCacheSize is the number of names kept by
+	// CachingResolver if no size is given
+	defaultResolverCacheSize = 1024
+)
+
+// CachingResolver wraps a NameResolver, caching its results by name.
+// Successful lookups are kept for TTL, lookups failing because the
+// name does not exist for NegativeTTL. Once Size names are cached the
+// least recently used one is evicted. Results are cached by name only,
+// so it should not wrap resolvers whose answers depend on the client.
+// It may be built as a literal: a nil Resolver defaults to DNSResolver
+// and a zero Size to 1024 names, but NegativeTTL is taken as is
+type CachingResolver struct {
+	Resolver    NameResolver
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	Size        int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	now     func() time.Time
+}
+
+type resolverCacheEntry struct {
+	name    string
+	ip      net.IP
+	err     error
+	expires time.Time
+}
+
+// NewCachingResolver creates a CachingResolver. A zero negativeTTL
+// defaults to a tenth of ttl, a zero size to 1024 names
+func NewCachingResolver(resolver NameResolver, ttl, negativeTTL time.Duration, size int) *CachingResolver {
+	if negativeTTL == 0 {
+		negativeTTL = ttl / 10
+	}
+	if size <= 0 {
+		size = defaultResolverCacheSize
+	}
+	return &CachingResolver{
+		Resolver:    resolver,
+		TTL:         ttl,
+		NegativeTTL: negativeTTL,
+		Size:        size,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		now:         time.Now,
+	}
+}
+
+func (c *CachingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	if entry, ok := c.get(name); ok {
+		return ctx, entry.ip, entry.err
+	}
+
+	resolver := c.Resolver
+	if resolver == nil {
+		resolver = DNSResolver{}
+	}
+	ctx, ip, err := resolver.Resolve(ctx, name)
+	if err == nil {
+		c.put(name, ip, nil, c.TTL)
+	} else if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		c.put(name, nil, err, c.NegativeTTL)
+	}
+	return ctx, ip, err
+}
+
+// initLocked sets up the state of a CachingResolver built as a literal.
+// c.mu must be held
+func (c *CachingResolver) initLocked() {
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+		c.lru = list.New()
+	}
+	if c.now == nil {
+		c.now = time.Now
+	}
+}
+
+// get returns the cached result for name, if any
+func (c *CachingResolver) get(name string) (*resolverCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.initLocked()
+
+	elem, ok := c.entries[name]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*resolverCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, name)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry, true
+}
+
+// put caches a result for name, evicting the least recently used
+// entry if the cache is full
+func (c *CachingResolver) put(name string, ip net.IP, err error, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.initLocked()
+
+	entry := &resolverCacheEntry{name, ip, err, c.now().Add(ttl)}
+	if elem, ok := c.entries[name]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[name] = c.lru.PushFront(entry)
+	size := c.Size
+	if size <= 0 {
+		size = defaultResolverCacheSize
+	}
+	for c.lru.Len() > size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*resolverCacheEntry).name)
+	}
+}
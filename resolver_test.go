@@ -1,7 +1,13 @@
 package socks
 
 import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -19,3 +25,139 @@ func TestDNSResolver(t *testing.T) {
 		t.Fatalf("expected loopback")
 	}
 }
+
+// countingResolver resolves every name to loopback, except "missing",
+// and counts the lookups
+type countingResolver struct {
+	lookups int
+}
+
+func (c *countingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	c.lookups++
+	if name == "missing" {
+		return ctx, nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return ctx, net.IPv4(127, 0, 0, 1), nil
+}
+
+func TestCachingResolver(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	under := &countingResolver{}
+	c := NewCachingResolver(under, time.Minute, time.Second, 2)
+	c.now = func() time.Time { return now }
+
+	if _, _, err := c.Resolve(ctx, "foo"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, addr, err := c.Resolve(ctx, "foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !addr.IsLoopback() {
+		t.Fatalf("expected loopback")
+	}
+	if under.lookups != 1 {
+		t.Fatalf("expected cached lookup: %d", under.lookups)
+	}
+
+	// Negative results expire sooner
+	c.Resolve(ctx, "missing")
+	if _, _, err := c.Resolve(ctx, "missing"); err == nil {
+		t.Fatalf("expected cached error")
+	}
+	if under.lookups != 2 {
+		t.Fatalf("expected cached negative lookup: %d", under.lookups)
+	}
+	now = now.Add(2 * time.Second)
+	c.Resolve(ctx, "missing")
+	c.Resolve(ctx, "foo")
+	if under.lookups != 3 {
+		t.Fatalf("expected expired negative lookup: %d", under.lookups)
+	}
+
+	// Entries expire
+	now = now.Add(time.Minute)
+	c.Resolve(ctx, "foo")
+	if under.lookups != 4 {
+		t.Fatalf("expected expired lookup: %d", under.lookups)
+	}
+
+	// The least recently used entry is evicted
+	c.Resolve(ctx, "bar")
+	c.Resolve(ctx, "foo")
+	c.Resolve(ctx, "baz")
+	c.Resolve(ctx, "foo")
+	if under.lookups != 6 {
+		t.Fatalf("expected foo to be cached: %d", under.lookups)
+	}
+	c.Resolve(ctx, "bar")
+	if under.lookups != 7 {
+		t.Fatalf("expected bar to be evicted: %d", under.lookups)
+	}
+}
+
+// splitHorizonResolver resolves names to loopback for internal
+// clients only
+func TestCachingResolver_Literal(t *testing.T) {
+	ctx := context.Background()
+	under := &countingResolver{}
+	c := &CachingResolver{Resolver: under, TTL: time.Minute}
+
+	for i := 0; i < 2; i++ {
+		_, addr, err := c.Resolve(ctx, "foo")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !addr.IsLoopback() {
+			t.Fatalf("expected loopback")
+		}
+	}
+	if under.lookups != 1 {
+		t.Fatalf("expected cached lookup: %d", under.lookups)
+	}
+}
+
+type splitHorizonResolver struct {
+	internal *net.IPNet
+}
+
+func (r splitHorizonResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	if client, ok := RemoteAddrFromContext(ctx); ok && r.internal.Contains(client.IP) {
+		return ctx, net.IPv4(127, 0, 0, 1), nil
+	}
+	return ctx, net.IPv4(192, 0, 2, 1), nil
+}
+
+func TestResolver_SplitHorizon(t *testing.T) {
+	_, internal, _ := net.ParseCIDR("10.0.0.0/8")
+
+	var dialed []string
+	s := &Server{config: &Config{
+		Rules:    PermitAll(),
+		Resolver: splitHorizonResolver{internal},
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return nil, fmt.Errorf("not dialing")
+		},
+	}}
+
+	for _, client := range []string{"10.1.2.3", "203.0.113.1"} {
+		buf := bytes.NewBuffer(nil)
+		buf.Write([]byte{5, 1, 0, 3, 12})
+		buf.Write([]byte("intranet.lan"))
+		buf.Write([]byte{0, 80})
+
+		req, err := NewRequest(buf, socks5Version)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		req.RemoteAddr = &AddrSpec{IP: net.ParseIP(client), Port: 1234}
+		s.handleRequest(req, &MockConn{})
+	}
+
+	if len(dialed) != 2 || dialed[0] != "127.0.0.1:80" || dialed[1] != "192.0.2.1:80" {
+		t.Fatalf("bad: %v", dialed)
+	}
+}
@@ -1,6 +1,9 @@
 package socks
 
 import (
+	"net"
+	"strings"
+
 	"golang.org/x/net/context"
 )
 
@@ -39,3 +42,205 @@ func (p *PermitCommand) Allow(ctx context.Context, req *Request) (context.Contex
 
 	return ctx, false
 }
+
+// SourceRules is an implementation of the RuleSet which filters
+// requests on the address of the client that sent them.
+// A request is denied if its source matches any of Denied, or if
+// Allowed is not empty and its source matches none of Allowed
+type SourceRules struct {
+	Allowed []*net.IPNet
+	Denied  []*net.IPNet
+}
+
+func (s *SourceRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	if req.RemoteAddr == nil {
+		return ctx, len(s.Allowed) == 0
+	}
+	ip := req.RemoteAddr.IP
+
+	for _, n := range s.Denied {
+		if n.Contains(ip) {
+			return ctx, false
+		}
+	}
+	if len(s.Allowed) == 0 {
+		return ctx, true
+	}
+	for _, n := range s.Allowed {
+		if n.Contains(ip) {
+			return ctx, true
+		}
+	}
+	return ctx, false
+}
+
+// DestRules is an implementation of the RuleSet which filters
+// requests on their destination IP. FQDN destinations are checked
+// against the IP the server resolved them to, without another lookup.
+// A request is denied if its destination matches any of Denied, or if
+// Allowed is not empty and its destination matches none of Allowed
+type DestRules struct {
+	Allowed []*net.IPNet
+	Denied  []*net.IPNet
+}
+
+func (d *DestRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	ip, ok := ResolvedIPFromContext(ctx)
+	if !ok && req.DestAddr != nil {
+		ip = req.DestAddr.IP
+	}
+	if ip == nil {
+		return ctx, len(d.Allowed) == 0
+	}
+
+	for _, n := range d.Denied {
+		if n.Contains(ip) {
+			return ctx, false
+		}
+	}
+	if len(d.Allowed) == 0 {
+		return ctx, true
+	}
+	for _, n := range d.Allowed {
+		if n.Contains(ip) {
+			return ctx, true
+		}
+	}
+	return ctx, false
+}
+
+// AndRules returns a RuleSet which allows a request only if all the
+// given rules allow it. Rules are evaluated in order, each one getting
+// the context returned by the previous, and evaluation stops at the
+// first rule that denies the request
+func AndRules(rules ...RuleSet) RuleSet {
+	return andRules(rules)
+}
+
+type andRules []RuleSet
+
+func (a andRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	for _, r := range a {
+		var ok bool
+		if ctx, ok = r.Allow(ctx, req); !ok {
+			return ctx, false
+		}
+	}
+	return ctx, true
+}
+
+// OrRules returns a RuleSet which allows a request if any of the given
+// rules allows it. Rules are evaluated in order and evaluation stops at
+// the first rule that allows the request, whose context is returned.
+// The context returned by rules denying the request is discarded
+func OrRules(rules ...RuleSet) RuleSet {
+	return orRules(rules)
+}
+
+type orRules []RuleSet
+
+func (o orRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	for _, r := range o {
+		if ctx_, ok := r.Allow(ctx, req); ok {
+			return ctx_, true
+		}
+	}
+	return ctx, false
+}
+
+// NotRules returns a RuleSet which allows a request only if the given
+// rule denies it
+func NotRules(rule RuleSet) RuleSet {
+	return &notRules{rule}
+}
+
+type notRules struct {
+	rule RuleSet
+}
+
+func (n *notRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	ctx, ok := n.rule.Allow(ctx, req)
+	return ctx, !ok
+}
+
+// PortRange is an inclusive range of ports. A single port is a range
+// with the same First and Last
+type PortRange struct {
+	First int
+	Last  int
+}
+
+// Contains reports whether port is in the range
+func (p PortRange) Contains(port int) bool {
+	return port >= p.First && port <= p.Last
+}
+
+// PortRules is an implementation of the RuleSet which filters
+// requests on their destination port.
+// A request is denied if its port is in any of Denied, or if Allowed
+// is not empty and its port is in none of Allowed
+type PortRules struct {
+	Allowed []PortRange
+	Denied  []PortRange
+}
+
+func (p *PortRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	if req.DestAddr == nil {
+		return ctx, len(p.Allowed) == 0
+	}
+	port := req.DestAddr.Port
+
+	for _, r := range p.Denied {
+		if r.Contains(port) {
+			return ctx, false
+		}
+	}
+	if len(p.Allowed) == 0 {
+		return ctx, true
+	}
+	for _, r := range p.Allowed {
+		if r.Contains(port) {
+			return ctx, true
+		}
+	}
+	return ctx, false
+}
+
+// UserPortRules is an implementation of the RuleSet which applies
+// different PortRules to each authenticated user, by username.
+// Requests of users without an entry, or without a username, are
+// denied. It is typically combined with other rules using AndRules
+type UserPortRules map[string]PortRules
+
+func (u UserPortRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	if req.AuthContext == nil {
+		return ctx, false
+	}
+	user, ok := req.AuthContext.Payload["Username"]
+	if !ok {
+		return ctx, false
+	}
+	rules, ok := u[user]
+	if !ok {
+		return ctx, false
+	}
+	return rules.Allow(ctx, req)
+}
+
+// hostBlocked reports whether host matches any of the patterns: either
+// an exact name, or "*.suffix" matching any subdomain of suffix.
+// Matching ignores case and trailing dots
+func hostBlocked(patterns []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSuffix(p, "."))
+		if strings.HasPrefix(p, "*.") {
+			if strings.HasSuffix(host, p[1:]) {
+				return true
+			}
+		} else if host == p {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,10 @@
 package socks
 
 import (
+	"bytes"
+	"log"
+	"net"
+	"os"
 	"testing"
 
 	"golang.org/x/net/context"
@@ -22,3 +26,234 @@ func TestPermitCommand(t *testing.T) {
 		t.Fatalf("do not expect associate")
 	}
 }
+
+func TestSourceRules(t *testing.T) {
+	ctx := context.Background()
+	cidrs := func(s ...string) []*net.IPNet {
+		var nets []*net.IPNet
+		for _, c := range s {
+			_, n, err := net.ParseCIDR(c)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			nets = append(nets, n)
+		}
+		return nets
+	}
+	from := func(ip string) *Request {
+		return &Request{Command: ConnectCommand, RemoteAddr: &AddrSpec{IP: net.ParseIP(ip), Port: 1234}}
+	}
+
+	r := &SourceRules{
+		Allowed: cidrs("10.0.0.0/8", "::1/128"),
+		Denied:  cidrs("10.1.0.0/16"),
+	}
+
+	if _, ok := r.Allow(ctx, from("10.0.0.1")); !ok {
+		t.Fatalf("expect allowed source")
+	}
+	if _, ok := r.Allow(ctx, from("::1")); !ok {
+		t.Fatalf("expect allowed ipv6 loopback")
+	}
+	if _, ok := r.Allow(ctx, from("10.1.0.1")); ok {
+		t.Fatalf("do not expect denied source")
+	}
+	if _, ok := r.Allow(ctx, from("192.168.1.1")); ok {
+		t.Fatalf("do not expect source outside allowed")
+	}
+	if _, ok := r.Allow(ctx, &Request{Command: ConnectCommand}); ok {
+		t.Fatalf("do not expect unknown source")
+	}
+
+	r = &SourceRules{Denied: cidrs("::1/128")}
+	if _, ok := r.Allow(ctx, from("::1")); ok {
+		t.Fatalf("do not expect denied ipv6 loopback")
+	}
+	if _, ok := r.Allow(ctx, from("127.0.0.1")); !ok {
+		t.Fatalf("expect source not denied")
+	}
+}
+
+// countingRule records how many times it has been evaluated
+type countingRule struct {
+	allow bool
+	calls int
+}
+
+func (c *countingRule) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	c.calls++
+	return ctx, c.allow
+}
+
+func TestDestRules(t *testing.T) {
+	_, denied, _ := net.ParseCIDR("10.0.0.0/8")
+	r := &DestRules{Denied: []*net.IPNet{denied}}
+
+	// An FQDN request, resolved by the server to a denied IP
+	s := &Server{config: &Config{
+		Rules:    r,
+		Resolver: staticResolver(net.ParseIP("10.0.0.1")),
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+	}}
+	buf := bytes.NewBuffer([]byte{5, 1, 0, FqdnAddress, 8})
+	buf.WriteString("internal")
+	buf.Write([]byte{0, 80})
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := &MockConn{}
+	if err := s.handleRequest(req, resp); err == nil {
+		t.Fatalf("expected error")
+	}
+	if out := resp.buf.Bytes(); out[1] != RuleFailure {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// The resolved IP is taken from the context
+	ctx := context.WithValue(context.Background(), resolvedIPKey{}, net.ParseIP("10.0.0.1"))
+	fqdn := &Request{Command: ConnectCommand, DestAddr: &AddrSpec{FQDN: "internal", Port: 80}}
+	if _, ok := r.Allow(ctx, fqdn); ok {
+		t.Fatalf("do not expect denied destination")
+	}
+	if _, ok := r.Allow(context.Background(), fqdn); !ok {
+		t.Fatalf("expect unresolved destination allowed")
+	}
+	ip := &Request{Command: ConnectCommand, DestAddr: &AddrSpec{IP: net.ParseIP("192.168.1.1"), Port: 80}}
+	if _, ok := r.Allow(context.Background(), ip); !ok {
+		t.Fatalf("expect allowed destination")
+	}
+
+	// With an allowlist, unresolved destinations are denied
+	r.Allowed = []*net.IPNet{{IP: net.IPv4(192, 168, 0, 0), Mask: net.CIDRMask(16, 32)}}
+	if _, ok := r.Allow(context.Background(), fqdn); ok {
+		t.Fatalf("do not expect unresolved destination allowed")
+	}
+}
+
+func TestRuleCombinators(t *testing.T) {
+	ctx := context.Background()
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	connectOnly := &PermitCommand{true, false, false}
+	fromLoopback := &SourceRules{Allowed: []*net.IPNet{loopback}}
+
+	req := func(cmd uint8, ip string) *Request {
+		return &Request{Command: cmd, RemoteAddr: &AddrSpec{IP: net.ParseIP(ip), Port: 1234}}
+	}
+
+	and := AndRules(connectOnly, fromLoopback)
+	if _, ok := and.Allow(ctx, req(ConnectCommand, "127.0.0.1")); !ok {
+		t.Fatalf("expect connect from loopback")
+	}
+	if _, ok := and.Allow(ctx, req(BindCommand, "127.0.0.1")); ok {
+		t.Fatalf("do not expect bind from loopback")
+	}
+	if _, ok := and.Allow(ctx, req(ConnectCommand, "10.0.0.1")); ok {
+		t.Fatalf("do not expect connect from remote")
+	}
+
+	or := OrRules(connectOnly, fromLoopback)
+	if _, ok := or.Allow(ctx, req(BindCommand, "127.0.0.1")); !ok {
+		t.Fatalf("expect bind from loopback")
+	}
+	if _, ok := or.Allow(ctx, req(ConnectCommand, "10.0.0.1")); !ok {
+		t.Fatalf("expect connect from remote")
+	}
+	if _, ok := or.Allow(ctx, req(BindCommand, "10.0.0.1")); ok {
+		t.Fatalf("do not expect bind from remote")
+	}
+
+	not := AndRules(connectOnly, NotRules(fromLoopback))
+	if _, ok := not.Allow(ctx, req(ConnectCommand, "127.0.0.1")); ok {
+		t.Fatalf("do not expect connect from loopback")
+	}
+	if _, ok := not.Allow(ctx, req(ConnectCommand, "10.0.0.1")); !ok {
+		t.Fatalf("expect connect from remote")
+	}
+
+	// Evaluation short-circuits
+	deny, allow := &countingRule{allow: false}, &countingRule{allow: true}
+	AndRules(deny, allow).Allow(ctx, req(ConnectCommand, "127.0.0.1"))
+	OrRules(allow, deny).Allow(ctx, req(ConnectCommand, "127.0.0.1"))
+	if deny.calls != 1 || allow.calls != 1 {
+		t.Fatalf("bad calls: %d %d", deny.calls, allow.calls)
+	}
+}
+
+func TestPortRules(t *testing.T) {
+	ctx := context.Background()
+	to := func(port int) *Request {
+		return &Request{Command: ConnectCommand, DestAddr: &AddrSpec{IP: net.IPv4(10, 0, 0, 1), Port: port}}
+	}
+
+	r := &PortRules{
+		Allowed: []PortRange{{80, 80}, {443, 443}, {1024, 65535}},
+		Denied:  []PortRange{{3128, 3128}, {6000, 6063}},
+	}
+
+	for _, port := range []int{80, 443, 1024, 8080, 65535} {
+		if _, ok := r.Allow(ctx, to(port)); !ok {
+			t.Fatalf("expect port %d", port)
+		}
+	}
+	for _, port := range []int{22, 81, 1023} {
+		if _, ok := r.Allow(ctx, to(port)); ok {
+			t.Fatalf("do not expect port %d", port)
+		}
+	}
+
+	// Denied ports take precedence
+	for _, port := range []int{3128, 6000, 6063} {
+		if _, ok := r.Allow(ctx, to(port)); ok {
+			t.Fatalf("do not expect denied port %d", port)
+		}
+	}
+
+	// Combined with command rules
+	connect := AndRules(&PermitCommand{true, false, false}, r)
+	if _, ok := connect.Allow(ctx, to(443)); !ok {
+		t.Fatalf("expect connect to 443")
+	}
+	bind := to(443)
+	bind.Command = BindCommand
+	if _, ok := connect.Allow(ctx, bind); ok {
+		t.Fatalf("do not expect bind")
+	}
+}
+
+func TestUserPortRules(t *testing.T) {
+	ctx := context.Background()
+	as := func(user string, port int) *Request {
+		req := &Request{Command: ConnectCommand, DestAddr: &AddrSpec{IP: net.IPv4(10, 0, 0, 1), Port: port}}
+		if user != "" {
+			req.AuthContext = &AuthContext{Method: UserPassAuth, Payload: map[string]string{"Username": user}}
+		}
+		return req
+	}
+
+	r := UserPortRules{
+		"alice": {Allowed: []PortRange{{443, 443}}},
+		"bob":   {Allowed: []PortRange{{80, 80}}},
+	}
+
+	if _, ok := r.Allow(ctx, as("alice", 443)); !ok {
+		t.Fatalf("expect alice to 443")
+	}
+	if _, ok := r.Allow(ctx, as("alice", 80)); ok {
+		t.Fatalf("do not expect alice to 80")
+	}
+	if _, ok := r.Allow(ctx, as("bob", 443)); ok {
+		t.Fatalf("do not expect bob to 443")
+	}
+	if _, ok := r.Allow(ctx, as("bob", 80)); !ok {
+		t.Fatalf("expect bob to 80")
+	}
+
+	// Unknown and anonymous users are denied
+	if _, ok := r.Allow(ctx, as("carol", 443)); ok {
+		t.Fatalf("do not expect carol")
+	}
+	if _, ok := r.Allow(ctx, as("", 443)); ok {
+		t.Fatalf("do not expect anonymous")
+	}
+}
@@ -0,0 +1,64 @@
+package socks
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TimeWindow is a daily time range, from Start to End as offsets from
+// midnight, on the given Days (every day if empty). A window with End
+// before Start spans midnight, and belongs to the day it starts on.
+type TimeWindow struct {
+	Days  []time.Weekday
+	Start time.Duration
+	End   time.Duration
+}
+
+// onDay reports whether the window applies to day
+func (w TimeWindow) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains reports whether t falls in the window
+func (w TimeWindow) Contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	if w.Start <= w.End {
+		return w.onDay(t.Weekday()) && offset >= w.Start && offset < w.End
+	}
+	yesterday := (t.Weekday() + 6) % 7
+	return (w.onDay(t.Weekday()) && offset >= w.Start) ||
+		(w.onDay(yesterday) && offset < w.End)
+}
+
+// ScheduleRules is an implementation of the RuleSet which only allows
+// requests while the current time, in Location (UTC if nil), falls in
+// any of Windows. The time is taken from the clock of the server
+type ScheduleRules struct {
+	Windows  []TimeWindow
+	Location *time.Location
+}
+
+func (s *ScheduleRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	clk := clockFromContext(ctx)
+	loc := s.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	now := clk.Now().In(loc)
+	for _, w := range s.Windows {
+		if w.Contains(now) {
+			return ctx, true
+		}
+	}
+	return ctx, false
+}
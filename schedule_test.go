@@ -0,0 +1,84 @@
+package socks
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestScheduleRules(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	clock := newFakeClock()
+	rules := &ScheduleRules{
+		Windows: []TimeWindow{
+			// Business hours
+			{
+				Days:  []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+				Start: 9 * time.Hour,
+				End:   17 * time.Hour,
+			},
+			// Saturday night, spanning midnight
+			{
+				Days:  []time.Weekday{time.Saturday},
+				Start: 22 * time.Hour,
+				End:   2 * time.Hour,
+			},
+		},
+		Location: loc,
+	}
+	ctx := context.WithValue(context.Background(), clockKey{}, clock)
+
+	for _, tc := range []struct {
+		now     time.Time
+		allowed bool
+	}{
+		{time.Date(2024, 1, 3, 9, 0, 0, 0, loc), true},        // Wednesday
+		{time.Date(2024, 1, 3, 16, 59, 0, 0, loc), true},      // Wednesday
+		{time.Date(2024, 1, 3, 17, 0, 0, 0, loc), false},      // Wednesday
+		{time.Date(2024, 1, 3, 6, 30, 0, 0, time.UTC), false}, // 08:30 in UTC+2
+		{time.Date(2024, 1, 3, 7, 30, 0, 0, time.UTC), true},  // 09:30 in UTC+2
+		{time.Date(2024, 1, 6, 12, 0, 0, 0, loc), false},      // Saturday
+		{time.Date(2024, 1, 6, 23, 0, 0, 0, loc), true},       // Saturday night
+		{time.Date(2024, 1, 7, 1, 0, 0, 0, loc), true},        // Sunday, still Saturday night
+		{time.Date(2024, 1, 7, 23, 0, 0, 0, loc), false},      // Sunday night
+	} {
+		clock.mu.Lock()
+		clock.now = tc.now
+		clock.mu.Unlock()
+		if _, ok := rules.Allow(ctx, &Request{}); ok != tc.allowed {
+			t.Fatalf("bad: %v %v", tc.now, ok)
+		}
+	}
+}
+
+func TestRequest_Connect_ScheduleRules(t *testing.T) {
+	clock := newFakeClock()
+	clock.now = time.Date(2024, 1, 6, 12, 0, 0, 0, time.UTC)
+	s := &Server{config: &Config{
+		Rules: &ScheduleRules{
+			Windows: []TimeWindow{{Start: 9 * time.Hour, End: 11 * time.Hour}},
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}}
+	s.clock = clock
+
+	buf := bytes.NewBuffer([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := &MockConn{}
+	if err := s.handleRequest(req, resp); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	out := resp.buf.Bytes()
+	expected := []byte{5, RuleFailure, 0, 1, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v %v", out, expected)
+	}
+}
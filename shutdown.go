@@ -0,0 +1,105 @@
+package socks
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// shutdownPollInterval is how often Shutdown checks whether all
+	// the connections are done
+	shutdownPollInterval = 10 * time.Millisecond
+)
+
+var (
+	ErrServerClosed = fmt.Errorf("socks: server closed")
+)
+
+// trackListener adds or removes a listener from the ones the server
+// is serving. It returns false if the server is shutting down
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.inShutdown {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+// trackConn adds or removes a connection from the ones the server
+// is serving. It returns false if the server is shutting down
+func (s *Server) trackConn(c net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	if !add {
+		delete(s.conns, c)
+		return true
+	}
+	if s.inShutdown {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inShutdown
+}
+
+// Drain stops accepting new connections, closing the listeners, but
+// leaves the active ones alone: they go on for as long as they last.
+// Progress can be followed with ActiveConnections, and Shutdown called
+// later to close the stragglers
+func (s *Server) Drain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inShutdown = true
+	for l := range s.listeners {
+		l.Close()
+	}
+}
+
+// Shutdown gracefully shuts down the server: it stops accepting new
+// connections, then waits for the active ones to finish. If ctx is done
+// first, the remaining connections are closed and ctx.Err() is returned.
+// It returns nil if all the connections finished on their own
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Drain()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.ActiveConnections() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			if s.cancelBase != nil {
+				s.cancelBase()
+			}
+			for c := range s.conns {
+				c.Close()
+			}
+			s.mu.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
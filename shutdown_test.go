@@ -0,0 +1,178 @@
+package socks
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// startShutdownServer starts a server, returning it with its address
+// and the channel Serve's result is sent to
+func startShutdownServer(t *testing.T) (*Server, string, <-chan error) {
+	serv, err := New(&Config{
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- serv.Serve(l) }()
+	return serv, l.Addr().String(), served
+}
+
+func TestServer_Shutdown_Forced(t *testing.T) {
+	target := startEchoServer(t)
+	serv, proxyAddr, served := startShutdownServer(t)
+
+	// A long-lived relay
+	conn, err := Dial("tcp", proxyAddr, target, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := serv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The relay has been closed
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// New connections are refused
+	if _, err := net.Dial("tcp", proxyAddr); err == nil {
+		t.Fatalf("expected refused connection")
+	}
+}
+
+func TestServer_Shutdown_Drained(t *testing.T) {
+	target := startEchoServer(t)
+	serv, proxyAddr, _ := startShutdownServer(t)
+
+	conn, err := Dial("tcp", proxyAddr, target, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+
+	// The relay finishes before the deadline
+	time.AfterFunc(50*time.Millisecond, func() { conn.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := serv.Shutdown(ctx); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := serv.ActiveConnections(); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestServer_Drain(t *testing.T) {
+	target := startEchoServer(t)
+	serv, proxyAddr, served := startShutdownServer(t)
+
+	conn, err := Dial("tcp", proxyAddr, target, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+
+	serv.Drain()
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("err: %v", err)
+	}
+
+	// New connections are refused
+	if _, err := net.Dial("tcp", proxyAddr); err == nil {
+		t.Fatalf("expected refused connection")
+	}
+
+	// The existing relay goes on
+	time.Sleep(50 * time.Millisecond)
+	testEcho(t, conn)
+	if n := serv.ActiveConnections(); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	// Shutdown can still close it
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := serv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestServer_MultipleListeners(t *testing.T) {
+	target := startEchoServer(t)
+	serv, err := New(&Config{
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var addrs []string
+	served := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		go func() { served <- serv.Serve(l) }()
+		addrs = append(addrs, l.Addr().String())
+	}
+
+	// Relays through both listeners are tracked together
+	for _, addr := range addrs {
+		conn, err := Dial("tcp", addr, target, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		testEcho(t, conn)
+	}
+	if n := serv.ActiveConnections(); n != 2 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := serv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-served; err != ErrServerClosed {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Both listeners are closed
+	for _, addr := range addrs {
+		if _, err := net.Dial("tcp", addr); err == nil {
+			t.Fatalf("expected %v to be closed", addr)
+		}
+	}
+}
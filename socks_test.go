@@ -3,12 +3,19 @@ package socks
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 func TestSOCKS5_Connect(t *testing.T) {
@@ -97,3 +104,877 @@ func TestSOCKS5_Connect(t *testing.T) {
 		t.Fatalf("bad: %v", out)
 	}
 }
+
+func TestSOCKS5_OnAuth(t *testing.T) {
+	type authEvent struct {
+		req     *Request
+		method  uint8
+		success bool
+	}
+	events := make(chan authEvent, 1)
+
+	creds := StaticCredentials{
+		"foo": "bar",
+	}
+	conf := &Config{
+		Credentials: creds,
+		Rules:       PermitNone(),
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+		OnAuth: func(ctx context.Context, req *Request, method uint8, success bool) {
+			events <- authEvent{req, method, success}
+		},
+	}
+	serv, err := New(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{5})
+	req.Write([]byte{2, NoAuth, UserPassAuth})
+	req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	req.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	conn.Write(req.Bytes())
+
+	select {
+	case ev := <-events:
+		if !ev.success {
+			t.Fatalf("expected successful auth")
+		}
+		if ev.method != UserPassAuth {
+			t.Fatalf("bad method: %v", ev.method)
+		}
+		if ev.req == nil || ev.req.AuthContext.Payload["Username"] != "foo" {
+			t.Fatalf("bad request: %v", ev.req)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("OnAuth not called")
+	}
+}
+
+func TestSOCKS5_OnAuth_BadRequest(t *testing.T) {
+	var success bool
+	s, err := New(&Config{
+		Credentials: StaticCredentials{"foo": "bar"},
+		OnAuth: func(ctx context.Context, req *Request, method uint8, ok bool) {
+			success = ok && req.AuthContext.Payload["Username"] == "foo"
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Authenticated, then an unknown address type
+	raw := []byte{5, 1, UserPassAuth, 1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r', 5, 1, 0, 9}
+	if err := s.ServeConn(newPipeConn(t, raw)); err == nil {
+		t.Fatalf("expected error")
+	}
+	if !success {
+		t.Fatalf("OnAuth not called")
+	}
+}
+
+func TestSOCKS5_PreventLoop(t *testing.T) {
+	serv, err := New(&Config{
+		PreventLoop: true,
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	conn, err := net.Dial("tcp", lAddr.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// Ask the proxy to connect to itself
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{5, 1, NoAuth})
+	req.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1})
+	binary.Write(req, binary.BigEndian, uint16(lAddr.Port))
+	conn.Write(req.Bytes())
+
+	expected := []byte{
+		socks5Version, NoAuth,
+		5, ConnectionRefused, 0, 1, 0, 0, 0, 0, 0, 0,
+	}
+	out := make([]byte, len(expected))
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAtLeast(conn, out, len(out)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestSOCKS5_PreventLoop_FQDN(t *testing.T) {
+	// No Resolver: the name is resolved for the check alone
+	s := &Server{config: &Config{
+		Rules:       PermitAll(),
+		PreventLoop: true,
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+	}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go s.Serve(l)
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	// Wait for the listener to be tracked
+	deadline := time.Now().Add(time.Second)
+	for !s.isSelfAddr(&AddrSpec{IP: lAddr.IP, Port: lAddr.Port}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("listener not tracked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	buf := bytes.NewBuffer([]byte{5, 1, 0, 3, 9})
+	buf.Write([]byte("localhost"))
+	binary.Write(buf, binary.BigEndian, uint16(lAddr.Port))
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := &MockConn{}
+	s.handleRequest(req, resp)
+	if out := resp.buf.Bytes(); len(out) < 2 || out[1] != ConnectionRefused {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+// hostRewriter rewrites every destination to a hostname
+type hostRewriter AddrSpec
+
+func (r hostRewriter) Rewrite(ctx context.Context, req *Request) (context.Context, *AddrSpec) {
+	return ctx, &AddrSpec{FQDN: r.FQDN, Port: r.Port}
+}
+
+func TestSOCKS5_PreventLoop_Resolver(t *testing.T) {
+	// The configured Resolver looks up rewritten hostnames
+	s := &Server{config: &Config{
+		Rules:       PermitAll(),
+		Resolver:    staticResolver(net.IPv4(127, 0, 0, 1)),
+		PreventLoop: true,
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+	}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	lAddr := l.Addr().(*net.TCPAddr)
+	s.config.Rewriter = hostRewriter{FQDN: "proxy.test", Port: lAddr.Port}
+	go s.Serve(l)
+
+	deadline := time.Now().Add(time.Second)
+	for !s.isSelfAddr(&AddrSpec{IP: lAddr.IP, Port: lAddr.Port}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("listener not tracked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	req, err := NewRequest(bytes.NewBuffer([]byte{5, 1, 0, 1, 10, 0, 0, 9, 0, 80}), socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := &MockConn{}
+	s.handleRequest(req, resp)
+	if out := resp.buf.Bytes(); len(out) < 2 || out[1] != ConnectionRefused {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestSOCKS5_WriteTimeout(t *testing.T) {
+	serv, err := New(&Config{
+		WriteTimeout: 100 * time.Millisecond,
+		Logger:       log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- serv.ServeConn(server) }()
+
+	// Send the greeting but never read the method selection
+	client.Write([]byte{5, 1, NoAuth})
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("server did not give up")
+	}
+}
+
+func TestSOCKS5_HandshakeTimeout(t *testing.T) {
+	serv, err := New(&Config{
+		HandshakeTimeout: 100 * time.Millisecond,
+		Logger:           log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- serv.ServeConn(server) }()
+
+	// Send the version byte and stall before the methods
+	client.Write([]byte{5})
+
+	select {
+	case err := <-errCh:
+		if err == nil || !strings.Contains(err.Error(), "failed to read number of methods") {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("server did not give up")
+	}
+}
+
+// panicRule is a RuleSet which panics
+type panicRule struct{}
+
+func (panicRule) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	panic("bad rule")
+}
+
+func TestSOCKS5_PanicRecovery(t *testing.T) {
+	panics := make(chan interface{}, 2)
+	serv, err := New(&Config{
+		Rules:   panicRule{},
+		OnPanic: func(v interface{}) { panics <- v },
+		Logger:  log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	// The server survives a panic, and keeps serving
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+
+		conn.Write([]byte{5, 1, NoAuth})
+		conn.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+
+		// The connection gets closed
+		conn.SetDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadAll(conn); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		select {
+		case v := <-panics:
+			if v != "bad rule" {
+				t.Fatalf("bad: %v", v)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("OnPanic not called")
+		}
+	}
+}
+
+func TestSOCKS5_OnCloseEgress(t *testing.T) {
+	// Create a local listener, reporting the peer address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	peers := make(chan net.Addr, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		peers <- conn.RemoteAddr()
+		conn.Close()
+	}()
+
+	closed := make(chan *Request, 1)
+	proxyAddr := startServer(t, &Config{
+		OnClose: func(ctx context.Context, req *Request, err error) {
+			closed <- req
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	conn, err := Dial("tcp", proxyAddr, l.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	peer := <-peers
+	conn.Close()
+
+	select {
+	case req := <-closed:
+		if req.EgressLocalAddr.String() != peer.String() {
+			t.Fatalf("bad egress local: %v %v", req.EgressLocalAddr, peer)
+		}
+		if req.EgressRemoteAddr.String() != l.Addr().String() {
+			t.Fatalf("bad egress remote: %v %v", req.EgressRemoteAddr, l.Addr())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("OnClose not called")
+	}
+}
+
+// slowResolver resolves every name to the same IP after a delay
+type slowResolver struct {
+	ip    net.IP
+	delay time.Duration
+}
+
+func (r slowResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	time.Sleep(r.delay)
+	return ctx, r.ip, nil
+}
+
+func TestSOCKS5_Timings(t *testing.T) {
+	target := startEchoServer(t)
+	_, port, _ := net.SplitHostPort(target)
+
+	closed := make(chan *Request, 1)
+	proxyAddr := startServer(t, &Config{
+		Resolver: slowResolver{net.IPv4(127, 0, 0, 1), 20 * time.Millisecond},
+		OnClose: func(ctx context.Context, req *Request, err error) {
+			closed <- req
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	conn, err := Dial("tcp", proxyAddr, net.JoinHostPort("echo.test", port), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+	conn.Close()
+
+	select {
+	case req := <-closed:
+		if req.Timings.Resolve < 20*time.Millisecond {
+			t.Fatalf("bad: %+v", req.Timings)
+		}
+		if req.Timings.Auth <= 0 || req.Timings.Dial <= 0 {
+			t.Fatalf("bad: %+v", req.Timings)
+		}
+		if req.Duration < req.Timings.Resolve+req.Timings.Dial {
+			t.Fatalf("bad: %v %+v", req.Duration, req.Timings)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("OnClose not called")
+	}
+}
+
+// ruleFunc is a RuleSet backed by a function
+type ruleFunc func(ctx context.Context, req *Request) (context.Context, bool)
+
+func (f ruleFunc) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return f(ctx, req)
+}
+
+func TestSOCKS5_ConnID(t *testing.T) {
+	target := startEchoServer(t)
+
+	type event struct {
+		name   string
+		ctxID  uint64
+		connID uint64
+	}
+	events := make(chan event, 8)
+	var ruleIDs []uint64
+	logs := &lockedBuffer{}
+	proxyAddr := startServer(t, &Config{
+		Rules: ruleFunc(func(ctx context.Context, req *Request) (context.Context, bool) {
+			id, _ := ConnIDFromContext(ctx)
+			ruleIDs = append(ruleIDs, id)
+			return ctx, true
+		}),
+		OnAuth: func(ctx context.Context, req *Request, method uint8, success bool) {
+			id, _ := ConnIDFromContext(ctx)
+			events <- event{"auth", id, req.ConnID}
+		},
+		OnClose: func(ctx context.Context, req *Request, err error) {
+			id, _ := ConnIDFromContext(ctx)
+			events <- event{"close", id, req.ConnID}
+		},
+		Logger: log.New(logs, "", 0),
+	})
+
+	seen := make(map[uint64]bool)
+	for i := 0; i < 2; i++ {
+		conn, err := Dial("tcp", proxyAddr, target, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		testEcho(t, conn)
+		conn.Close()
+
+		var got []event
+		for len(got) < 2 {
+			select {
+			case e := <-events:
+				got = append(got, e)
+			case <-time.After(time.Second):
+				t.Fatalf("missing events: %v", got)
+			}
+		}
+
+		// The same ID is seen from accept to close, and differs
+		// between connections
+		id := got[0].ctxID
+		if id == 0 || seen[id] {
+			t.Fatalf("bad: %v", got)
+		}
+		seen[id] = true
+		for _, e := range got {
+			if e.ctxID != id || e.connID != id {
+				t.Fatalf("bad: %v", got)
+			}
+		}
+		if ruleIDs[i] != id {
+			t.Fatalf("bad: %v %v", ruleIDs, id)
+		}
+	}
+
+	// Log lines carry the ID of the next connection
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Write([]byte{9})
+	io.ReadAll(conn)
+	conn.Close()
+	prefix := fmt.Sprintf("[ERR] socks: conn %d: ", ruleIDs[1]+1)
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(logs.String(), prefix) {
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %q", logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// tunedConn records the socket options set on it
+type tunedConn struct {
+	MockConn
+	keepAlive       bool
+	keepAlivePeriod time.Duration
+	noDelay         bool
+}
+
+func (c *tunedConn) SetKeepAlive(keepalive bool) error {
+	c.keepAlive = keepalive
+	return nil
+}
+
+func (c *tunedConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.keepAlivePeriod = d
+	return nil
+}
+
+func (c *tunedConn) SetNoDelay(noDelay bool) error {
+	c.noDelay = noDelay
+	return nil
+}
+
+func TestTuneConn(t *testing.T) {
+	s, _ := New(&Config{})
+	c := &tunedConn{}
+	s.tuneConn(c)
+	if !c.keepAlive || c.keepAlivePeriod != defaultKeepAlivePeriod || !c.noDelay {
+		t.Fatalf("bad: %+v", c)
+	}
+
+	s, _ = New(&Config{KeepAlivePeriod: time.Minute})
+	c = &tunedConn{}
+	s.tuneConn(c)
+	if !c.keepAlive || c.keepAlivePeriod != time.Minute {
+		t.Fatalf("bad: %+v", c)
+	}
+
+	s, _ = New(&Config{KeepAlivePeriod: -1, DisableNoDelay: true})
+	c = &tunedConn{keepAlive: true, noDelay: true}
+	s.tuneConn(c)
+	if c.keepAlive || c.noDelay {
+		t.Fatalf("bad: %+v", c)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	invalid := []*Config{
+		{AuthMethods: []Authenticator{nil}},
+		{WriteTimeout: -time.Second},
+		{BindTimeout: -time.Second},
+		{ResolverCacheSize: -1},
+		{UDPMaxDatagramSize: 1 << 20},
+		{BindPort: 70000},
+		{BindIP: net.IP{127, 0, 0}},
+		{AdvertiseHost: string(make([]byte, 256))},
+		{DSCP: 64},
+		{CustomAddrTypes: map[uint8]func(io.Reader) (*AddrSpec, error){Ipv4Address: readAddrSpecV4}},
+		{MaxAuthAttempts: -1},
+		{AuthLockout: &AuthLockout{MaxFailures: 3}},
+	}
+	for _, conf := range invalid {
+		if _, err := New(conf); err == nil {
+			t.Fatalf("expected error for %+v", conf)
+		}
+	}
+
+	valid := &Config{
+		Credentials:        StaticCredentials{"foo": "bar"},
+		ResolverCacheTTL:   time.Minute,
+		UDPMaxDatagramSize: 1500,
+		BindIP:             net.ParseIP("127.0.0.1"),
+		BindPort:           1081,
+		WriteTimeout:       time.Second,
+	}
+	if _, err := New(valid); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestConfig_Validate_HostBlocklist(t *testing.T) {
+	for _, p := range []string{"", "*", "*foo", "*foo.test", "*.", "*..", "a*.test", "*.*.test"} {
+		conf := &Config{HostBlocklist: []string{p}}
+		if err := conf.Validate(); err == nil {
+			t.Fatalf("expected error for %q", p)
+		}
+	}
+	conf := &Config{HostBlocklist: []string{"bad.example", "*.evil.test", "*.evil.test."}}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSOCKS5_PipelinedPayload(t *testing.T) {
+	target := startEchoServer(t)
+	_, port, _ := net.SplitHostPort(target)
+	proxyAddr := startServer(t, &Config{
+		Resolver: staticResolver(net.IPv4(127, 0, 0, 1)),
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// Greeting, FQDN request and a payload larger than the read buffer,
+	// all in one write
+	payload := bytes.Repeat([]byte("0123456789"), 1000)
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{5, 1, NoAuth})
+	req.Write([]byte{5, 1, 0, FqdnAddress, 12})
+	req.Write([]byte("example.test"))
+	p, _ := strconv.Atoi(port)
+	binary.Write(req, binary.BigEndian, uint16(p))
+	req.Write(payload)
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	header := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if header[3] != SuccessReply {
+		t.Fatalf("bad: %v", header)
+	}
+
+	out := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, payload) {
+		t.Fatalf("payload mismatch")
+	}
+}
+
+func TestServer_ActiveConnections(t *testing.T) {
+	serv, err := New(&Config{
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	waitFor := func(n int) {
+		deadline := time.Now().Add(time.Second)
+		for serv.ActiveConnections() != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d connections, got %d", n, serv.ActiveConnections())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	const n = 10
+	var conns []net.Conn
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conns = append(conns, conn)
+	}
+	waitFor(n)
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	waitFor(0)
+}
+
+func TestSOCKS5_CustomAddrTypes(t *testing.T) {
+	target := startEchoServer(t)
+	tAddr, _ := net.ResolveTCPAddr("tcp", target)
+
+	// ATYP 5 carries a one byte backend index, without a port
+	var seen []byte
+	proxyAddr := startServer(t, &Config{
+		CustomAddrTypes: map[uint8]func(io.Reader) (*AddrSpec, error){
+			0x05: func(r io.Reader) (*AddrSpec, error) {
+				idx := []byte{0}
+				if _, err := io.ReadFull(r, idx); err != nil {
+					return nil, err
+				}
+				seen = append(seen, idx[0])
+				return &AddrSpec{IP: tAddr.IP, Port: tAddr.Port}, nil
+			},
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	if _, err := conn.Write([]byte{5, 1, NoAuth, 5, ConnectCommand, 0, 0x05, 7}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[3] != SuccessReply {
+		t.Fatalf("bad: %v", out)
+	}
+	testEcho(t, conn)
+
+	if !bytes.Equal(seen, []byte{7}) {
+		t.Fatalf("bad: %v", seen)
+	}
+}
+
+func TestSOCKS5_CustomAddrTypes_NoAddr(t *testing.T) {
+	s, err := New(&Config{
+		CustomAddrTypes: map[uint8]func(io.Reader) (*AddrSpec, error){
+			0x05: func(r io.Reader) (*AddrSpec, error) { return nil, nil },
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	err = s.ServeConn(newPipeConn(t, []byte{5, 1, NoAuth, 5, ConnectCommand, 0, 0x05}))
+	if err == nil || !strings.Contains(err.Error(), "no address parsed for address type 5") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSOCKS5_TuneConn(t *testing.T) {
+	target := startEchoServer(t)
+	tAddr, _ := net.ResolveTCPAddr("tcp", target)
+
+	type tuned struct {
+		port               int
+		client, dest       net.Conn
+		clientErr, destErr error
+	}
+	tunedCh := make(chan tuned, 1)
+	proxyAddr := startServer(t, &Config{
+		// The access log wraps the client connection
+		AccessLogWriter: io.Discard,
+		TuneConn: func(req *Request, clientConn, destConn net.Conn) {
+			res := tuned{port: req.DestAddr.Port, client: clientConn, dest: destConn}
+			if c, ok := clientConn.(*net.TCPConn); ok {
+				res.clientErr = c.SetNoDelay(false)
+			}
+			if c, ok := destConn.(*net.TCPConn); ok {
+				res.destErr = c.SetNoDelay(false)
+			}
+			tunedCh <- res
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	req := bytes.NewBuffer([]byte{5, 1, NoAuth, 5, ConnectCommand, 0, Ipv4Address, 127, 0, 0, 1})
+	binary.Write(req, binary.BigEndian, uint16(tAddr.Port))
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+
+	res := <-tunedCh
+	if res.port != tAddr.Port {
+		t.Fatalf("bad: %v", res.port)
+	}
+	if _, ok := res.client.(*net.TCPConn); !ok {
+		t.Fatalf("bad: %T", res.client)
+	}
+	if res.client.RemoteAddr().String() != conn.LocalAddr().String() {
+		t.Fatalf("bad: %v", res.client.RemoteAddr())
+	}
+	if _, ok := res.dest.(*net.TCPConn); !ok {
+		t.Fatalf("bad: %T", res.dest)
+	}
+	if res.clientErr != nil || res.destErr != nil {
+		t.Fatalf("err: %v %v", res.clientErr, res.destErr)
+	}
+}
+
+// flakyListener fails its first accepts with a temporary error
+type flakyListener struct {
+	net.Listener
+	failures int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if atomic.AddInt32(&l.failures, -1) >= 0 {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServe_AcceptBackoff(t *testing.T) {
+	s, err := New(&Config{Logger: log.New(os.Stdout, "", log.LstdFlags)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	clock := useFakeClock(s)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go s.Serve(&flakyListener{Listener: l, failures: 3})
+
+	// The wait doubles on each failure
+	for _, expected := range []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond} {
+		clock.BlockUntil(1)
+		clock.mu.Lock()
+		wait := clock.timers[0].deadline.Sub(clock.now)
+		clock.mu.Unlock()
+		if wait != expected {
+			t.Fatalf("bad: %v %v", wait, expected)
+		}
+		clock.Advance(wait)
+	}
+
+	// Then connections are served again
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte{5, 1, NoAuth})
+	out := make([]byte, 2)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, []byte{5, NoAuth}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestServe_AcceptPermanentError(t *testing.T) {
+	s, err := New(&Config{Logger: log.New(os.Stdout, "", log.LstdFlags)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l.Close()
+	if err := s.Serve(l); err == nil || err == ErrServerClosed {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+// Package sockstest provides utilities for testing with a SOCKS server.
+package sockstest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	socks "github.com/ferama/go-socks"
+	"golang.org/x/net/context"
+)
+
+// shutdownTimeout bounds how long cleanup waits for active connections
+const shutdownTimeout = 5 * time.Second
+
+// NewTestServer starts a server with the given config on an ephemeral
+// loopback port. It returns the address the server listens on and a
+// function shutting the server down, which is also registered with
+// t.Cleanup, so calling it is optional.
+func NewTestServer(t testing.TB, conf *socks.Config) (addr string, cleanup func()) {
+	t.Helper()
+
+	serv, err := socks.New(conf)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go serv.Serve(l)
+
+	var done bool
+	cleanup = func() {
+		if done {
+			return
+		}
+		done = true
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		serv.Shutdown(ctx)
+	}
+	t.Cleanup(cleanup)
+	return l.Addr().String(), cleanup
+}
@@ -0,0 +1,54 @@
+package sockstest
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	socks "github.com/ferama/go-socks"
+)
+
+func TestNewTestServer(t *testing.T) {
+	// Create a local echo server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	addr, cleanup := NewTestServer(t, &socks.Config{})
+
+	conn, err := socks.Dial("tcp", addr, l.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := make([]byte, 4)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "ping" {
+		t.Fatalf("bad: %s", out)
+	}
+	conn.Close()
+
+	// The server is gone after cleanup
+	cleanup()
+	if _, err := socks.Dial("tcp", addr, l.Addr().String(), nil); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,63 @@
+package socks
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	// TapUpstream is the direction of data sent by the client
+	TapUpstream = "upstream"
+	// TapDownstream is the direction of data sent to the client
+	TapDownstream = "downstream"
+)
+
+// tap wraps r so that the data read is copied to the writer returned by
+// Config.Tap for the given direction
+func (s *Server) tap(req *Request, direction string, r io.Reader) io.Reader {
+	if s.config.Tap == nil {
+		return r
+	}
+	w := s.config.Tap(req, direction)
+	if w == nil {
+		return r
+	}
+	return &tapReader{s: s, r: r, w: w, direction: direction, connID: req.ConnID}
+}
+
+// tapReader copies what it reads to w. Failures and panics of w are
+// logged and stop the copy, but never affect the relay
+type tapReader struct {
+	s         *Server
+	r         io.Reader
+	w         io.Writer
+	direction string
+	connID    uint64
+	failed    bool
+}
+
+func (t *tapReader) Read(b []byte) (int, error) {
+	n, err := t.r.Read(b)
+	if n > 0 && !t.failed {
+		if werr := t.write(b[:n]); werr != nil {
+			t.s.config.Logger.Printf("[ERR] socks: conn %d: tap for %s data failed: %v", t.connID, t.direction, werr)
+			t.failed = true
+		}
+	}
+	return n, err
+}
+
+// write copies b to w, turning a panic of w into an error: it runs in
+// the relay goroutines, where a panic would crash the server
+func (t *tapReader) write(b []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if t.s.config.OnPanic != nil {
+				t.s.config.OnPanic(r)
+			}
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	_, err = t.w.Write(b)
+	return err
+}
@@ -0,0 +1,104 @@
+package socks
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingWriter is an io.Writer which always fails
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("tap is down")
+}
+
+// panickingWriter is an io.Writer which always panics
+type panickingWriter struct{}
+
+func (panickingWriter) Write(p []byte) (int, error) {
+	panic("tap is broken")
+}
+
+func TestTap_Connect(t *testing.T) {
+	echoAddr := startEchoServer(t)
+
+	var mu sync.Mutex
+	taps := make(map[string]*lockedBuffer)
+	proxyAddr := startServer(t, &Config{
+		Tap: func(req *Request, direction string) io.Writer {
+			mu.Lock()
+			defer mu.Unlock()
+			taps[direction] = &lockedBuffer{}
+			return taps[direction]
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	conn, err := Dial("tcp", proxyAddr, echoAddr, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+	conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		up, down := taps[TapUpstream], taps[TapDownstream]
+		mu.Unlock()
+		if up != nil && down != nil && up.String() == "ping" && down.String() == "ping" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %v %v", up, down)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTap_FailingWriter(t *testing.T) {
+	echoAddr := startEchoServer(t)
+
+	proxyAddr := startServer(t, &Config{
+		Tap: func(req *Request, direction string) io.Writer {
+			return failingWriter{}
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	conn, err := Dial("tcp", proxyAddr, echoAddr, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// The relay is not affected
+	testEcho(t, conn)
+	testEcho(t, conn)
+}
+
+func TestTap_PanickingWriter(t *testing.T) {
+	echoAddr := startEchoServer(t)
+
+	proxyAddr := startServer(t, &Config{
+		Tap: func(req *Request, direction string) io.Writer {
+			return panickingWriter{}
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	conn, err := Dial("tcp", proxyAddr, echoAddr, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// The panic is contained, the relay goes on
+	testEcho(t, conn)
+	testEcho(t, conn)
+}
@@ -0,0 +1,58 @@
+package socks
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+)
+
+// Span names used with Config.Tracer
+const (
+	SpanAuth    = "socks.auth"
+	SpanRequest = "socks.request"
+	SpanResolve = "socks.resolve"
+	SpanDial    = "socks.dial"
+	SpanRelay   = "socks.relay"
+)
+
+// Tracer is used to trace the phases of connections, e.g. by bridging
+// to OpenTelemetry. Spans are started with the context of the phase
+// they cover, and the returned context is used for the nested ones
+type Tracer interface {
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a traced phase. SetAttribute records details such as the
+// destination ("socks.dest"), command ("socks.command") or reply code
+// ("socks.reply_code"); End is called once, with the phase error if any
+type Span interface {
+	SetAttribute(key string, value interface{})
+	End(err error)
+}
+
+// noopSpan is used when there is no tracer
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) End(err error)                              {}
+
+// startSpan starts a span with Config.Tracer, if set
+func (s *Server) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if s.config.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return s.config.Tracer.StartSpan(ctx, name)
+}
+
+// replyCode returns the reply code a request handled with the given
+// error got, assuming the handlers reply success when returning nil
+func replyCode(err error) uint8 {
+	if err == nil {
+		return SuccessReply
+	}
+	var replyErr *ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.Code
+	}
+	return ServerFailure
+}
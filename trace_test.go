@@ -0,0 +1,152 @@
+package socks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// mockSpan records what is traced
+type mockSpan struct {
+	tracer *mockTracer
+	name   string
+	parent string
+	attrs  map[string]interface{}
+	err    error
+	ended  bool
+}
+
+func (s *mockSpan) SetAttribute(key string, value interface{}) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.attrs[key] = value
+}
+
+func (s *mockSpan) End(err error) {
+	s.tracer.mu.Lock()
+	s.err = err
+	s.ended = true
+	s.tracer.mu.Unlock()
+	if s.name == SpanRequest {
+		close(s.tracer.done)
+	}
+}
+
+type mockSpanKey struct{}
+
+// mockTracer records the spans, with the name of their parent
+type mockTracer struct {
+	mu    sync.Mutex
+	spans []*mockSpan
+	done  chan struct{}
+}
+
+func (t *mockTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	span := &mockSpan{tracer: t, name: name, attrs: make(map[string]interface{})}
+	if parent, ok := ctx.Value(mockSpanKey{}).(*mockSpan); ok {
+		span.parent = parent.name
+	}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, mockSpanKey{}, span), span
+}
+
+func TestTracer(t *testing.T) {
+	target := startEchoServer(t)
+	_, port, _ := net.SplitHostPort(target)
+	p, _ := strconv.Atoi(port)
+
+	tracer := &mockTracer{done: make(chan struct{})}
+	proxyAddr := startServer(t, &Config{
+		Resolver: staticResolver(net.IPv4(127, 0, 0, 1)),
+		Tracer:   tracer,
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	req := bytes.NewBuffer([]byte{5, 1, NoAuth, 5, ConnectCommand, 0, FqdnAddress, 12})
+	req.WriteString("example.test")
+	binary.Write(req, binary.BigEndian, uint16(p))
+	conn.Write(req.Bytes())
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, 2+10)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+	conn.Close()
+
+	select {
+	case <-tracer.done:
+	case <-time.After(time.Second):
+		t.Fatalf("request span not ended")
+	}
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	expected := []struct{ name, parent string }{
+		{SpanAuth, ""},
+		{SpanRequest, ""},
+		{SpanResolve, SpanRequest},
+		{SpanDial, SpanRequest},
+		{SpanRelay, SpanRequest},
+	}
+	if len(tracer.spans) != len(expected) {
+		t.Fatalf("bad: %d spans", len(tracer.spans))
+	}
+	for i, e := range expected {
+		span := tracer.spans[i]
+		if span.name != e.name || span.parent != e.parent || !span.ended {
+			t.Fatalf("bad: %d %+v", i, span)
+		}
+	}
+
+	request := tracer.spans[1].attrs
+	if request["socks.command"] != ConnectCommand ||
+		request["socks.dest"] != "example.test:"+port ||
+		request["socks.reply_code"] != SuccessReply {
+		t.Fatalf("bad: %v", request)
+	}
+	if tracer.spans[2].attrs["socks.dest"] != "example.test" {
+		t.Fatalf("bad: %v", tracer.spans[2].attrs)
+	}
+	if tracer.spans[3].attrs["socks.dest"] != target || tracer.spans[3].err != nil {
+		t.Fatalf("bad: %+v", tracer.spans[3])
+	}
+}
+
+func TestTracer_ReplyCode(t *testing.T) {
+	tracer := &mockTracer{done: make(chan struct{})}
+	s := &Server{config: &Config{
+		Rules:  PermitNone(),
+		Tracer: tracer,
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	req, err := NewRequest(bytes.NewBuffer([]byte{5, 1, 0, 1, 10, 0, 0, 1, 0, 80}), socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.handleRequest(req, &MockConn{}); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	span := tracer.spans[0]
+	if span.name != SpanRequest || span.attrs["socks.reply_code"] != RuleFailure || span.err == nil {
+		t.Fatalf("bad: %+v", span)
+	}
+}
@@ -0,0 +1,95 @@
+package socks
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// DestinationTracker is used to observe the destinations of CONNECT
+// requests. Record is called once per allowed request with the
+// requested destination as host:port, where host is the FQDN if the
+// client sent one
+type DestinationTracker interface {
+	Record(dest string)
+}
+
+// DestinationCount is the number of connections to a destination
+type DestinationCount struct {
+	Dest  string
+	Count int64
+}
+
+// OtherDestinations is the destination DestinationCounter counts
+// connections under once it tracks MaxDestinations destinations
+const OtherDestinations = "other"
+
+// defaultMaxDestinations is the number of destinations tracked by a
+// DestinationCounter if MaxDestinations is not set
+const defaultMaxDestinations = 10000
+
+// DestinationCounter is a DestinationTracker counting connections per
+// destination. Recording an already seen destination doesn't lock.
+// Destinations are never forgotten, so at most MaxDestinations of them,
+// 10000 if zero, are tracked: connections to any further destination
+// are counted under OtherDestinations
+type DestinationCounter struct {
+	n int64 // destinations tracked, first for 64-bit alignment
+
+	MaxDestinations int
+
+	counts sync.Map // string -> *int64
+}
+
+func (d *DestinationCounter) Record(dest string) {
+	if c, ok := d.counts.Load(dest); ok {
+		atomic.AddInt64(c.(*int64), 1)
+		return
+	}
+
+	max := int64(d.MaxDestinations)
+	if max <= 0 {
+		max = defaultMaxDestinations
+	}
+	if atomic.AddInt64(&d.n, 1) > max {
+		atomic.AddInt64(&d.n, -1)
+		dest = OtherDestinations
+	}
+	c, loaded := d.counts.LoadOrStore(dest, new(int64))
+	if loaded && dest != OtherDestinations {
+		atomic.AddInt64(&d.n, -1)
+	}
+	atomic.AddInt64(c.(*int64), 1)
+}
+
+// Top returns the n destinations with the most connections, sorted
+// by decreasing count. n <= 0 returns all of them
+func (d *DestinationCounter) Top(n int) []DestinationCount {
+	var top []DestinationCount
+	d.counts.Range(func(k, v interface{}) bool {
+		top = append(top, DestinationCount{k.(string), atomic.LoadInt64(v.(*int64))})
+		return true
+	})
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Dest < top[j].Dest
+	})
+	if n > 0 && len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// trackedDest formats the destination of a request for a
+// DestinationTracker
+func trackedDest(a *AddrSpec) string {
+	host := a.FQDN
+	if host == "" {
+		host = a.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(a.Port))
+}
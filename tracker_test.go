@@ -0,0 +1,57 @@
+package socks
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestDestinationCounter(t *testing.T) {
+	d := &DestinationCounter{}
+
+	var wg sync.WaitGroup
+	record := func(dest string, n int) {
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				d.Record(dest)
+			}()
+		}
+	}
+	record("example.com:443", 5)
+	record("10.0.0.1:22", 2)
+	record("example.org:80", 7)
+	record("example.net:80", 2)
+	wg.Wait()
+
+	expected := []DestinationCount{
+		{"example.org:80", 7},
+		{"example.com:443", 5},
+		{"10.0.0.1:22", 2},
+	}
+	if top := d.Top(3); !reflect.DeepEqual(top, expected) {
+		t.Fatalf("bad: %v", top)
+	}
+	if top := d.Top(0); len(top) != 4 {
+		t.Fatalf("bad: %v", top)
+	}
+}
+
+func TestDestinationCounter_MaxDestinations(t *testing.T) {
+	d := &DestinationCounter{MaxDestinations: 2}
+	d.Record("example.com:443")
+	d.Record("example.org:80")
+	d.Record("example.net:80")
+	d.Record("example.com:443")
+	d.Record("10.0.0.1:22")
+
+	expected := []DestinationCount{
+		{"example.com:443", 2},
+		{OtherDestinations, 2},
+		{"example.org:80", 1},
+	}
+	if top := d.Top(0); !reflect.DeepEqual(top, expected) {
+		t.Fatalf("bad: %v", top)
+	}
+}
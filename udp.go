@@ -0,0 +1,395 @@
+package socks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// udpKeepAlive is the answer to a client keepalive: an empty datagram
+// from the unspecified address
+var udpKeepAlive = []byte{0, 0, 0, Ipv4Address, 0, 0, 0, 0, 0, 0}
+
+const (
+	// defaultUDPMaxDatagramSize is the largest datagram relayed
+	// by an udp association if Config.UDPMaxDatagramSize is not set
+	defaultUDPMaxDatagramSize = 64 * 1024
+
+	// udpMaxTargets is how many destinations an udp association may
+	// open a socket for, when the source port is not stable
+	udpMaxTargets = 64
+
+	// udpMaxDests is how many destinations an udp association
+	// remembers the address and policy decision of
+	udpMaxDests = 1024
+
+	// udpReplyHeaderRoom is the space kept in front of reply datagrams
+	// for their header: reserved bytes, fragment number and an IPv6
+	// address with its port
+	udpReplyHeaderRoom = 3 + 1 + net.IPv6len + 2
+)
+
+// udpMaxDatagramSize returns the largest datagram the relay accepts
+func (s *Server) udpMaxDatagramSize() int {
+	if s.config.UDPMaxDatagramSize > 0 {
+		return s.config.UDPMaxDatagramSize
+	}
+	return defaultUDPMaxDatagramSize
+}
+
+// getUDPBuffer returns a buffer from the pool. The buffer is one byte
+// larger than the max datagram size, so that oversized datagrams can
+// be detected instead of being silently truncated, plus the room for
+// the header of replies
+func (s *Server) getUDPBuffer() *[]byte {
+	size := udpReplyHeaderRoom + s.udpMaxDatagramSize() + 1
+	if buf, ok := s.udpBufPool.Get().(*[]byte); ok && len(*buf) == size {
+		return buf
+	}
+	buf := make([]byte, size)
+	return &buf
+}
+
+// putUDPBuffer gives a buffer back to the pool
+func (s *Server) putUDPBuffer(buf *[]byte) {
+	s.udpBufPool.Put(buf)
+}
+
+// relayUDP is used to shuffle datagrams between the client and the
+// destinations of an udp association. It returns once one of the
+// sockets is closed. Relayed datagrams count as activity for idle, which
+// may be nil. Datagrams are sent from target, unless newTarget is set:
+// then target is only used for the first destination, the others get
+// their own socket from newTarget.
+func (s *Server) relayUDP(ctx context.Context, relay *net.UDPConn, target net.PacketConn, newTarget func() (net.PacketConn, error), req *Request, idle *idleWatcher) {
+	clientAddr := make(chan *net.UDPAddr, 1)
+	go s.relayUDPReplies(req.ConnID, target, relay, clientAddr, idle)
+
+	var firstDest string
+	targets := make(map[string]net.PacketConn)
+	defer func() {
+		for dest, t := range targets {
+			if dest != firstDest {
+				t.Close()
+			}
+		}
+	}()
+
+	buf := s.getUDPBuffer()
+	defer s.putUDPBuffer(buf)
+
+	reassembly := &udpReassembly{
+		clock:   s.clk(),
+		timeout: udpReassemblyTimeout,
+		maxSize: s.udpMaxDatagramSize(),
+	}
+
+	dests := make(map[string]udpDest)
+
+	var client *net.UDPAddr
+	for {
+		n, src, err := relay.ReadFromUDP(*buf)
+		if err != nil {
+			return
+		}
+		if n > s.udpMaxDatagramSize() {
+			s.config.Logger.Printf("[ERR] socks: conn %d: dropping oversized datagram from %v", req.ConnID, src)
+			continue
+		}
+
+		// Only accept datagrams from the client that owns the association
+		if req.RemoteAddr != nil && !src.IP.Equal(req.RemoteAddr.IP) {
+			continue
+		}
+		if client == nil {
+			client = src
+			clientAddr <- client
+		} else if src.Port != client.Port || !src.IP.Equal(client.IP) {
+			continue
+		}
+
+		dest, data, frag, err := parseUDPDatagram((*buf)[:n])
+		if err != nil {
+			s.config.Logger.Printf("[ERR] socks: conn %d: dropping datagram from %v: %v", req.ConnID, src, err)
+			continue
+		}
+
+		// Fragments are dropped, unless reassembly is enabled
+		if frag != 0 {
+			if !s.config.UDPAllowFragments {
+				continue
+			}
+			if dest, data = reassembly.add(frag, dest, data); dest == nil {
+				continue
+			}
+		} else {
+			reassembly.reset()
+		}
+
+		// Empty datagrams are keepalives: answer them, so that the
+		// bindings on the way back to the client stay open too
+		if s.config.UDPKeepAlive && len(data) == 0 {
+			idle.touch()
+			if _, err := relay.WriteToUDP(udpKeepAlive, src); err != nil {
+				s.config.Logger.Printf("[ERR] socks: conn %d: failed to answer keepalive from %v: %v", req.ConnID, src, err)
+			}
+			continue
+		}
+
+		// Resolve and check each destination once
+		key := dest.Address()
+		d, ok := dests[key]
+		if !ok {
+			d = s.udpResolveDest(ctx, req, dest)
+			if len(dests) >= udpMaxDests {
+				dests = make(map[string]udpDest)
+			}
+			dests[key] = d
+		}
+		if d.err != nil {
+			s.config.Logger.Printf("[ERR] socks: conn %d: dropping datagram to %v: %v", req.ConnID, dest, d.err)
+			continue
+		}
+		destAddr := d.addr
+
+		out := target
+		if newTarget != nil {
+			out = targets[destAddr.String()]
+			switch {
+			case out != nil:
+			case len(targets) == 0:
+				firstDest = destAddr.String()
+				out = target
+				targets[firstDest] = out
+			case len(targets) >= udpMaxTargets:
+				s.config.Logger.Printf("[ERR] socks: conn %d: dropping datagram to %v: too many destinations", req.ConnID, dest)
+				continue
+			default:
+				if out, err = newTarget(); err != nil {
+					s.config.Logger.Printf("[ERR] socks: conn %d: failed to open udp socket to %v: %v", req.ConnID, dest, err)
+					continue
+				}
+				targets[destAddr.String()] = out
+				replyTo := make(chan *net.UDPAddr, 1)
+				replyTo <- client
+				go s.relayUDPReplies(req.ConnID, out, relay, replyTo, idle)
+			}
+		}
+
+		if _, err := out.WriteTo(data, destAddr); err != nil {
+			s.config.Logger.Printf("[ERR] socks: conn %d: failed to relay datagram to %v: %v", req.ConnID, dest, err)
+			continue
+		}
+		idle.touch()
+	}
+}
+
+// udpDest is what an udp association learnt about a destination: the
+// address its datagrams are sent to, or why they are dropped
+type udpDest struct {
+	addr *net.UDPAddr
+	err  error
+}
+
+// udpResolveDest resolves the destination of a datagram and applies
+// the CONNECT policies to it. Relays remember the result, so that
+// datagrams don't each cost a lookup
+func (s *Server) udpResolveDest(ctx context.Context, req *Request, dest *AddrSpec) udpDest {
+	// Check blocked hostnames before any lookup
+	if dest.FQDN != "" && hostBlocked(s.config.HostBlocklist, dest.FQDN) {
+		return udpDest{err: fmt.Errorf("blocked by host blocklist")}
+	}
+
+	resolved := *dest
+	if dest.FQDN != "" && s.config.Resolver != nil {
+		_, addr, err := s.config.Resolver.Resolve(ctx, dest.FQDN)
+		if err != nil {
+			return udpDest{err: fmt.Errorf("failed to resolve destination: %w", err)}
+		}
+		resolved.IP = addr
+	}
+	destAddr, err := net.ResolveUDPAddr("udp", s.withIPv6Zone(&resolved).Address())
+	if err != nil {
+		return udpDest{err: fmt.Errorf("failed to resolve destination: %w", err)}
+	}
+	if err := s.udpDestAllowed(ctx, req, &resolved, destAddr.IP); err != nil {
+		return udpDest{err: err}
+	}
+	return udpDest{addr: destAddr}
+}
+
+// udpDestAllowed checks the destination of a datagram, with ip the
+// address it is sent to, against the policies applied to CONNECT
+// destinations: the rules, evaluated on a copy of the associate request
+// for dest, loop prevention, the checks on the final IP and AllowDial.
+// It returns why the destination is refused, or nil if it is allowed
+func (s *Server) udpDestAllowed(ctx context.Context, req *Request, dest *AddrSpec, ip net.IP) error {
+	destReq := *req
+	destReq.DestAddr = &AddrSpec{FQDN: dest.FQDN, IP: dest.IP, Port: dest.Port}
+	if dest.FQDN != "" {
+		destReq.Resolved = true
+		destReq.ResolvedIP = ip
+		ctx = context.WithValue(ctx, resolvedIPKey{}, ip)
+	}
+	if _, ok := s.config.Rules.Allow(ctx, &destReq); !ok {
+		return fmt.Errorf("blocked by rules")
+	}
+	if s.config.PreventLoop && s.isSelfAddr(&AddrSpec{IP: ip, Port: dest.Port}) {
+		return fmt.Errorf("destination is the proxy itself")
+	}
+	if s.metadataBlocked(ip) {
+		return fmt.Errorf("cloud metadata endpoint")
+	}
+	if s.privateBlocked(ip) {
+		return fmt.Errorf("private destination")
+	}
+	if !s.egressAllowed(ip) {
+		return fmt.Errorf("blocked by egress allowlist")
+	}
+	if s.config.AllowDial != nil {
+		if err := s.config.AllowDial(ctx, &destReq, ip, dest.Port); err != nil {
+			return fmt.Errorf("blocked: %w", err)
+		}
+	}
+	return nil
+}
+
+// relayUDPReplies is used to send datagrams coming from the destinations
+// back to the client, once its address is known
+func (s *Server) relayUDPReplies(connID uint64, target net.PacketConn, relay *net.UDPConn, clientAddr <-chan *net.UDPAddr, idle *idleWatcher) {
+	buf := s.getUDPBuffer()
+	defer s.putUDPBuffer(buf)
+
+	var client *net.UDPAddr
+	for {
+		n, from, err := target.ReadFrom((*buf)[udpReplyHeaderRoom:])
+		if err != nil {
+			return
+		}
+		src, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if n > s.udpMaxDatagramSize() {
+			s.config.Logger.Printf("[ERR] socks: conn %d: dropping oversized datagram from %v", connID, src)
+			continue
+		}
+		if client == nil {
+			select {
+			case client = <-clientAddr:
+			default:
+				// Nobody to send it to yet
+				continue
+			}
+		}
+
+		// Prepend the header in the room kept for it
+		start := putUDPReplyHeader((*buf)[:udpReplyHeaderRoom], src)
+		if _, err := relay.WriteToUDP((*buf)[start:udpReplyHeaderRoom+n], client); err != nil {
+			s.config.Logger.Printf("[ERR] socks: conn %d: failed to relay datagram to %v: %v", connID, client, err)
+			continue
+		}
+		idle.touch()
+	}
+}
+
+// putUDPReplyHeader writes the header of a datagram from src at the end
+// of b, which is udpReplyHeaderRoom long, returning where it starts
+func putUDPReplyHeader(b []byte, src *net.UDPAddr) int {
+	ip, atyp := src.IP.To4(), byte(Ipv4Address)
+	if ip == nil {
+		ip, atyp = src.IP.To16(), Ipv6Address
+	}
+	start := len(b) - (3 + 1 + len(ip) + 2)
+	h := b[start:]
+	h[0], h[1], h[2], h[3] = 0, 0, 0, atyp
+	copy(h[4:], ip)
+	binary.BigEndian.PutUint16(h[4+len(ip):], uint16(src.Port))
+	return start
+}
+
+// parseUDPDatagram is used to split a client datagram into its
+// destination, payload and fragment number. Expects two reserved bytes,
+// the fragment number and an address as in readAddrSpecV5
+func parseUDPDatagram(b []byte) (*AddrSpec, []byte, uint8, error) {
+	if len(b) < 4 {
+		return nil, nil, 0, fmt.Errorf("short datagram")
+	}
+
+	r := bytes.NewReader(b[3:])
+	dest, err := readAddrSpecV5(r, nil)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return dest, b[len(b)-r.Len():], b[2], nil
+}
+
+const (
+	// udpReassemblyTimeout is how long the fragments of a datagram
+	// are waited for, the minimum allowed by RFC 1928
+	udpReassemblyTimeout = 5 * time.Second
+
+	// udpFragEnd marks the last fragment of a datagram
+	udpFragEnd = 0x80
+)
+
+// udpReassembly is the queue of the fragments of a client datagram,
+// as described in RFC 1928 section 7
+type udpReassembly struct {
+	clock   clock
+	timeout time.Duration
+	maxSize int
+
+	dest    *AddrSpec
+	data    []byte
+	last    uint8
+	started time.Time
+}
+
+// reset abandons the datagram being reassembled
+func (r *udpReassembly) reset() {
+	r.dest = nil
+	r.data = nil
+	r.last = 0
+}
+
+// add queues a fragment. Once the last fragment is added, it returns
+// the destination and payload of the whole datagram
+func (r *udpReassembly) add(frag uint8, dest *AddrSpec, data []byte) (*AddrSpec, []byte) {
+	pos := frag &^ udpFragEnd
+	if pos == 0 {
+		r.reset()
+		return nil, nil
+	}
+
+	// Start over on timeout, or when a fragment is out of sequence:
+	// a gap means one was lost, and the datagram can't be completed
+	if r.dest != nil && (pos != r.last+1 || r.clock.Now().Sub(r.started) > r.timeout) {
+		r.reset()
+	}
+	if r.dest == nil {
+		// The start of the datagram was lost
+		if pos != 1 {
+			return nil, nil
+		}
+		r.dest = dest
+		r.started = r.clock.Now()
+	}
+	if len(r.data)+len(data) > r.maxSize {
+		r.reset()
+		return nil, nil
+	}
+	r.data = append(r.data, data...)
+	r.last = pos
+
+	if frag&udpFragEnd == 0 {
+		return nil, nil
+	}
+	dest, data = r.dest, r.data
+	r.reset()
+	return dest, data
+}
@@ -0,0 +1,702 @@
+package socks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// startUDPAssociate starts a server with the given config and opens an
+// udp association on it. It returns the control connection and the
+// relay address
+func startUDPAssociate(t *testing.T, conf *Config) (net.Conn, *net.UDPAddr) {
+	serv, err := New(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go serv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	conn.Write([]byte{5, 1, NoAuth})
+	conn.Write([]byte{5, AssociateCommand, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	out := make([]byte, 12)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAtLeast(conn, out, len(out)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[3] != SuccessReply {
+		t.Fatalf("bad: %v", out)
+	}
+
+	return conn, &net.UDPAddr{
+		IP:   net.IP(out[6:10]),
+		Port: int(binary.BigEndian.Uint16(out[10:12])),
+	}
+}
+
+// startUDPEcho starts an udp echo server, which also reports the source
+// address of every datagram it gets
+func startUDPEcho(t *testing.T) (*net.UDPAddr, <-chan *net.UDPAddr) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { echo.Close() })
+
+	sources := make(chan *net.UDPAddr, 16)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case sources <- addr:
+			default:
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return echo.LocalAddr().(*net.UDPAddr), sources
+}
+
+func TestUDPAssociate_MaxDatagramSize(t *testing.T) {
+	// Create a local echo server
+	echoAddr, _ := startUDPEcho(t)
+
+	const maxSize = 512
+	_, relayAddr := startUDPAssociate(t, &Config{
+		UDPMaxDatagramSize: maxSize,
+		Logger:             log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+
+	datagram := func(size int) []byte {
+		msg := bytes.NewBuffer(nil)
+		msg.Write([]byte{0, 0, 0, Ipv4Address, 127, 0, 0, 1})
+		binary.Write(msg, binary.BigEndian, uint16(echoAddr.Port))
+		msg.Write(bytes.Repeat([]byte{'x'}, size-msg.Len()))
+		return msg.Bytes()
+	}
+
+	// A datagram at the limit is relayed
+	if _, err := client.Write(datagram(maxSize)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := make([]byte, 2048)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := client.Read(out)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out[:n], datagram(maxSize)) {
+		t.Fatalf("bad: %v", out[:n])
+	}
+
+	// A datagram above the limit is dropped
+	if _, err := client.Write(datagram(maxSize + 1)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := client.Read(out); err == nil {
+		t.Fatalf("unexpected datagram: %v", out[:n])
+	}
+}
+
+func TestUDPAssociate_LocalAddr(t *testing.T) {
+	echoAddr, sources := startUDPEcho(t)
+
+	egress := net.ParseIP("127.0.0.2")
+	_, relayAddr := startUDPAssociate(t, &Config{
+		LocalAddr: egress,
+		Logger:    log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+
+	msg := bytes.NewBuffer(nil)
+	msg.Write([]byte{0, 0, 0, Ipv4Address, 127, 0, 0, 1})
+	binary.Write(msg, binary.BigEndian, uint16(echoAddr.Port))
+	msg.Write([]byte("ping"))
+	if _, err := client.Write(msg.Bytes()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case src := <-sources:
+		if !src.IP.Equal(egress) {
+			t.Fatalf("bad source: %v", src)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("datagram not relayed")
+	}
+}
+
+func TestUDPAssociate_BindPort(t *testing.T) {
+	// Find a free udp port
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	_, relayAddr := startUDPAssociate(t, &Config{
+		BindIP:   net.ParseIP("127.0.0.1"),
+		BindPort: port,
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if !relayAddr.IP.Equal(net.ParseIP("127.0.0.1")) || relayAddr.Port != port {
+		t.Fatalf("bad: %v", relayAddr)
+	}
+
+	// The reported port is the one the relay listens on
+	if _, err := net.ListenUDP("udp", relayAddr); err == nil {
+		t.Fatalf("expected %v to be in use", relayAddr)
+	}
+}
+
+func TestUDPAssociate_MaxLifetime(t *testing.T) {
+	conn, relayAddr := startUDPAssociate(t, &Config{
+		UDPAssociationMaxLifetime: 100 * time.Millisecond,
+		Logger:                    log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	// The control connection is closed once the association expires,
+	// even if the client keeps it open
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// And the relay socket is released
+	relay, err := net.ListenUDP("udp", relayAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	relay.Close()
+}
+
+func TestUDPAssociate_IPv6(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+
+	serv, err := New(&Config{Logger: log.New(os.Stdout, "", log.LstdFlags)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte{5, 1, NoAuth})
+	conn.Write([]byte{5, AssociateCommand, 0, Ipv6Address})
+	conn.Write(make([]byte, 16+2))
+
+	// The relay is reachable over IPv6
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := make([]byte, 4+16+2)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[1] != SuccessReply || out[3] != Ipv6Address {
+		t.Fatalf("bad: %v", out)
+	}
+	relayAddr := &net.UDPAddr{
+		IP:   net.IP(out[4:20]),
+		Port: int(binary.BigEndian.Uint16(out[20:22])),
+	}
+	if !relayAddr.IP.Equal(net.IPv6loopback) {
+		t.Fatalf("bad: %v", relayAddr)
+	}
+
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+
+	msg := bytes.NewBuffer(nil)
+	msg.Write([]byte{0, 0, 0, Ipv6Address})
+	msg.Write(net.IPv6loopback)
+	binary.Write(msg, binary.BigEndian, uint16(echoAddr.Port))
+	msg.Write([]byte("ping"))
+	if _, err := client.Write(msg.Bytes()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The reply is encapsulated with the IPv6 source
+	reply := make([]byte, 2048)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := client.Read(reply)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(reply[:n], msg.Bytes()) {
+		t.Fatalf("bad: %v", reply[:n])
+	}
+}
+
+// localAddrConn is a MockConn with a given local address
+type localAddrConn struct {
+	MockConn
+	local net.Addr
+}
+
+func (c *localAddrConn) LocalAddr() net.Addr { return c.local }
+
+func TestServer_RelayIP(t *testing.T) {
+	s := &Server{config: &Config{}}
+	for _, tc := range []struct {
+		local    net.Addr
+		expected net.IP
+	}{
+		{&net.TCPAddr{IP: net.IPv6loopback}, net.IPv6loopback},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:127.0.0.2")}, net.IP{127, 0, 0, 2}},
+		{&net.TCPAddr{IP: net.IPv6unspecified}, net.ParseIP("127.0.0.1")},
+		{&net.UnixAddr{Name: "sock"}, net.ParseIP("127.0.0.1")},
+	} {
+		ip := s.relayIP(&localAddrConn{local: tc.local})
+		if !ip.Equal(tc.expected) || len(ip) != len(tc.expected) {
+			t.Fatalf("bad: %v %v", tc.local, ip)
+		}
+	}
+}
+
+func TestRequest_Associate_ListenPacketError(t *testing.T) {
+	s := &Server{config: &Config{
+		Rules:  PermitAll(),
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+		ListenPacket: func(ctx context.Context, network, addr string) (net.PacketConn, error) {
+			return nil, fmt.Errorf("udp is disabled")
+		},
+	}}
+
+	buf := bytes.NewBuffer([]byte{5, AssociateCommand, 0, 1, 0, 0, 0, 0, 0, 0})
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := &MockConn{}
+	err = s.handleRequest(req, resp)
+	if err == nil || !strings.Contains(err.Error(), "udp is disabled") {
+		t.Fatalf("err: %v", err)
+	}
+
+	out := resp.buf.Bytes()
+	expected := []byte{5, ServerFailure, 0, 1, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v %v", out, expected)
+	}
+}
+
+func TestRequest_Associate_BadAdvertisedAddr(t *testing.T) {
+	s := &Server{config: &Config{
+		Rules:         PermitAll(),
+		AdvertiseHost: strings.Repeat("a", 256),
+		Logger:        log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	buf := bytes.NewBuffer([]byte{5, AssociateCommand, 0, 1, 0, 0, 0, 0, 0, 0})
+	req, err := NewRequest(buf, socks5Version)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := &MockConn{}
+	if err := s.handleRequest(req, resp); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	out := resp.buf.Bytes()
+	expected := []byte{5, ServerFailure, 0, 1, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v %v", out, expected)
+	}
+}
+
+func TestUDPAssociate_KeepAlive(t *testing.T) {
+	echoAddr, _ := startUDPEcho(t)
+
+	conn, relayAddr := startUDPAssociate(t, &Config{
+		UDPIdleTimeout: 200 * time.Millisecond,
+		UDPKeepAlive:   true,
+		Logger:         log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+
+	msg := bytes.NewBuffer(nil)
+	msg.Write([]byte{0, 0, 0, Ipv4Address, 127, 0, 0, 1})
+	binary.Write(msg, binary.BigEndian, uint16(echoAddr.Port))
+	keepAlive := msg.Bytes()
+	ping := append(append([]byte{}, keepAlive...), "ping"...)
+
+	echo := func() {
+		if _, err := client.Write(ping); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		out := make([]byte, 2048)
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := client.Read(out)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Equal(out[:n], ping) {
+			t.Fatalf("bad: %v", out[:n])
+		}
+	}
+
+	// A burst, then a pause longer than the idle timeout filled with
+	// keepalives, which are answered but not relayed
+	echo()
+	out := make([]byte, 2048)
+	for i := 0; i < 8; i++ {
+		if _, err := client.Write(keepAlive); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := client.Read(out)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Equal(out[:n], udpKeepAlive) {
+			t.Fatalf("bad: %v", out[:n])
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	echo()
+
+	// Without activity, the association ends
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestUDPAssociate_Fragments(t *testing.T) {
+	echoAddr, _ := startUDPEcho(t)
+
+	header := func(frag byte) []byte {
+		msg := bytes.NewBuffer(nil)
+		msg.Write([]byte{0, 0, frag, Ipv4Address, 127, 0, 0, 1})
+		binary.Write(msg, binary.BigEndian, uint16(echoAddr.Port))
+		return msg.Bytes()
+	}
+
+	for _, allow := range []bool{false, true} {
+		_, relayAddr := startUDPAssociate(t, &Config{
+			UDPAllowFragments: allow,
+			Logger:            log.New(os.Stdout, "", log.LstdFlags),
+		})
+
+		client, err := net.DialUDP("udp", nil, relayAddr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer client.Close()
+
+		// Two fragments, the second marked as the last one
+		client.Write(append(header(1), "pi"...))
+		client.Write(append(header(udpFragEnd|2), "ng"...))
+
+		out := make([]byte, 2048)
+		client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := client.Read(out)
+		if !allow {
+			if err == nil {
+				t.Fatalf("unexpected datagram: %v", out[:n])
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Equal(out[:n], append(header(0), "ping"...)) {
+			t.Fatalf("bad: %v", out[:n])
+		}
+
+		// Fragments 1 and 3 are not relayed as one datagram
+		client.Write(append(header(1), "pi"...))
+		client.Write(append(header(udpFragEnd|3), "ng"...))
+		client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if n, err := client.Read(out); err == nil {
+			t.Fatalf("unexpected datagram: %v", out[:n])
+		}
+	}
+}
+
+func TestUDPReassembly(t *testing.T) {
+	clock := newFakeClock()
+	r := &udpReassembly{clock: clock, timeout: udpReassemblyTimeout, maxSize: 8}
+	dest := &AddrSpec{IP: net.ParseIP("127.0.0.1"), Port: 53}
+
+	// Out of sequence fragments start over
+	r.add(1, dest, []byte("a"))
+	r.add(2, dest, []byte("b"))
+	r.add(1, dest, []byte("c"))
+	if d, data := r.add(udpFragEnd|2, dest, []byte("d")); d != dest || string(data) != "cd" {
+		t.Fatalf("bad: %v %q", d, data)
+	}
+
+	// A missing fragment drops the datagram
+	r.add(1, dest, []byte("a"))
+	if d, _ := r.add(udpFragEnd|3, dest, []byte("c")); d != nil {
+		t.Fatalf("bad: %v", d)
+	}
+	if d, _ := r.add(udpFragEnd|2, dest, []byte("b")); d != nil {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Expired fragments are abandoned
+	r.add(1, dest, []byte("a"))
+	clock.Advance(udpReassemblyTimeout + time.Second)
+	if d, _ := r.add(udpFragEnd|2, dest, []byte("b")); d != nil {
+		t.Fatalf("bad: %v", d)
+	}
+
+	// Oversized datagrams are dropped
+	r.reset()
+	r.add(1, dest, []byte("12345"))
+	if d, _ := r.add(udpFragEnd|2, dest, []byte("6789")); d != nil {
+		t.Fatalf("bad: %v", d)
+	}
+}
+
+func TestUDPAssociate_StableSourcePort(t *testing.T) {
+	for _, stable := range []bool{false, true} {
+		first, firstSources := startUDPEcho(t)
+		second, secondSources := startUDPEcho(t)
+		_, relayAddr := startUDPAssociate(t, &Config{
+			UDPStableSourcePort: stable,
+			Logger:              log.New(os.Stdout, "", log.LstdFlags),
+		})
+
+		client, err := net.DialUDP("udp", nil, relayAddr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer client.Close()
+
+		var ports []int
+		for _, dest := range []struct {
+			addr    *net.UDPAddr
+			sources <-chan *net.UDPAddr
+		}{{first, firstSources}, {second, secondSources}, {first, firstSources}} {
+			msg := []byte{0, 0, 0, Ipv4Address, 127, 0, 0, 1, byte(dest.addr.Port >> 8), byte(dest.addr.Port)}
+			msg = append(msg, "ping"...)
+			if _, err := client.Write(msg); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+
+			// Replies come back from every socket
+			reply := make([]byte, 2048)
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := client.Read(reply)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if !bytes.Equal(reply[:n], msg) {
+				t.Fatalf("bad: %v", reply[:n])
+			}
+			ports = append(ports, (<-dest.sources).Port)
+		}
+
+		if ports[0] != ports[2] {
+			t.Fatalf("bad: %v", ports)
+		}
+		if (ports[0] == ports[1]) != stable {
+			t.Fatalf("bad: stable %v: %v", stable, ports)
+		}
+	}
+}
+
+// udpRelayed sends a datagram for dest through the relay client is
+// connected to, reporting whether it was echoed back
+func udpRelayed(t *testing.T, client *net.UDPConn, dest *AddrSpec) bool {
+	header, err := dest.MarshalBinary()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	msg := append([]byte{0, 0, 0}, header...)
+	msg = append(msg, "ping"...)
+	if _, err := client.Write(msg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := make([]byte, 2048)
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := client.Read(out)
+	return err == nil && bytes.HasSuffix(out[:n], []byte("ping"))
+}
+
+func TestUDPAssociate_Rules(t *testing.T) {
+	allowedAddr, _ := startUDPEcho(t)
+	deniedAddr, denied := startUDPEcho(t)
+
+	// Only the associate request itself and the allowed port pass
+	_, relayAddr := startUDPAssociate(t, &Config{
+		Rules: ruleFunc(func(ctx context.Context, req *Request) (context.Context, bool) {
+			return ctx, req.DestAddr.Port == 0 || req.DestAddr.Port == allowedAddr.Port
+		}),
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+
+	if udpRelayed(t, client, &AddrSpec{IP: deniedAddr.IP, Port: deniedAddr.Port}) {
+		t.Fatalf("denied destination relayed")
+	}
+	if !udpRelayed(t, client, &AddrSpec{IP: allowedAddr.IP, Port: allowedAddr.Port}) {
+		t.Fatalf("allowed destination not relayed")
+	}
+	select {
+	case src := <-denied:
+		t.Fatalf("unexpected datagram from %v", src)
+	default:
+	}
+}
+
+func TestUDPAssociate_HostBlocklist(t *testing.T) {
+	echoAddr, _ := startUDPEcho(t)
+	_, relayAddr := startUDPAssociate(t, &Config{
+		HostBlocklist: []string{"*.blocked.test"},
+		Resolver:      staticResolver(echoAddr.IP),
+		Logger:        log.New(os.Stdout, "", log.LstdFlags),
+	})
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+
+	if udpRelayed(t, client, &AddrSpec{FQDN: "echo.blocked.test", Port: echoAddr.Port}) {
+		t.Fatalf("blocked host relayed")
+	}
+	if !udpRelayed(t, client, &AddrSpec{FQDN: "echo.test", Port: echoAddr.Port}) {
+		t.Fatalf("host not relayed")
+	}
+}
+
+func TestUDPAssociate_ResolveOnce(t *testing.T) {
+	echoAddr, _ := startUDPEcho(t)
+	var lookups int32
+	_, relayAddr := startUDPAssociate(t, &Config{
+		Resolver: resolverFunc(func(ctx context.Context, name string) (context.Context, net.IP, error) {
+			atomic.AddInt32(&lookups, 1)
+			return ctx, echoAddr.IP, nil
+		}),
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		if !udpRelayed(t, client, &AddrSpec{FQDN: "echo.test", Port: echoAddr.Port}) {
+			t.Fatalf("host not relayed")
+		}
+	}
+	if n := atomic.LoadInt32(&lookups); n != 1 {
+		t.Fatalf("bad: %d lookups", n)
+	}
+}
+
+// resolverFunc is a NameResolver backed by a function
+type resolverFunc func(ctx context.Context, name string) (context.Context, net.IP, error)
+
+func (f resolverFunc) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return f(ctx, name)
+}
+
+func TestUDPAssociate_AllowDial(t *testing.T) {
+	allowedAddr, _ := startUDPEcho(t)
+	deniedAddr, _ := startUDPEcho(t)
+
+	_, relayAddr := startUDPAssociate(t, &Config{
+		AllowDial: func(ctx context.Context, req *Request, ip net.IP, port int) error {
+			if port == deniedAddr.Port {
+				return fmt.Errorf("denied port")
+			}
+			return nil
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+
+	if udpRelayed(t, client, &AddrSpec{IP: deniedAddr.IP, Port: deniedAddr.Port}) {
+		t.Fatalf("denied destination relayed")
+	}
+	if !udpRelayed(t, client, &AddrSpec{IP: allowedAddr.IP, Port: allowedAddr.Port}) {
+		t.Fatalf("allowed destination not relayed")
+	}
+}
@@ -0,0 +1,134 @@
+package socks
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// httpConnectError is returned when the upstream HTTP proxy refuses a
+// CONNECT
+type httpConnectError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *httpConnectError) Error() string {
+	return fmt.Sprintf("upstream proxy refused connect: %s", e.Status)
+}
+
+// reply returns the SOCKS reply code matching the upstream response
+func (e *httpConnectError) reply() uint8 {
+	switch e.StatusCode {
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return RuleFailure
+	case http.StatusBadGateway, http.StatusNotFound:
+		return HostUnreachable
+	case http.StatusGatewayTimeout:
+		return TtlExpired
+	case http.StatusServiceUnavailable:
+		return NetworkUnreachable
+	default:
+		return ServerFailure
+	}
+}
+
+// parseHTTPProxyURL is used to validate Config.UpstreamHTTPProxy
+func parseHTTPProxyURL(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported scheme: %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+	return u, nil
+}
+
+// dialHTTPProxy connects to addr through the upstream HTTP proxy, using
+// the CONNECT method
+func (s *Server) dialHTTPProxy(ctx context.Context, network, addr string) (net.Conn, error) {
+	u, err := parseHTTPProxyURL(s.config.UpstreamHTTPProxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy: %v", err)
+	}
+	// The address goes verbatim into the request line
+	if !validFQDN(addr) {
+		return nil, fmt.Errorf("invalid connect address %q", addr)
+	}
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		proxyAddr = net.JoinHostPort(u.Hostname(), "80")
+	}
+
+	d := net.Dialer{Control: s.socketControl()}
+	conn, err := d.DialContext(ctx, network, proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Honor the context during the handshake
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if u.User != nil {
+		password, _ := u.User.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req += "Proxy-Authorization: Basic " + cred + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send connect: %v", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read connect response: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, &httpConnectError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	conn.SetDeadline(time.Time{})
+
+	// The upstream may have sent tunneled data along with the response
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn reading through a buffer holding data
+// already received
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CloseWrite is used to keep half-closes working through the wrapper
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// startHTTPProxy starts a fake HTTP proxy supporting CONNECT, which
+// requires the given basic credentials and denies port 81
+func startHTTPProxy(t *testing.T, user, pass string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != auth {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				if _, port, _ := net.SplitHostPort(req.Host); port == "81" {
+					io.WriteString(conn, "HTTP/1.1 403 Forbidden\r\n\r\n")
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(target, br)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestUpstreamHTTPProxy_Connect(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	upstream := startHTTPProxy(t, "foo", "bar")
+
+	proxyAddr := startServer(t, &Config{
+		UpstreamHTTPProxy: "http://foo:bar@" + upstream,
+		Logger:            log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	conn, err := Dial("tcp", proxyAddr, echoAddr, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+}
+
+func TestUpstreamHTTPProxy_Refused(t *testing.T) {
+	upstream := startHTTPProxy(t, "foo", "bar")
+
+	for _, tc := range []struct {
+		proxy string
+		port  byte
+		reply uint8
+	}{
+		{"http://foo:bar@" + upstream, 81, RuleFailure},
+		{"http://foo:baz@" + upstream, 80, RuleFailure},
+		{"http://foo:bar@" + upstream, 1, HostUnreachable},
+	} {
+		s := &Server{config: &Config{
+			Rules:             PermitAll(),
+			UpstreamHTTPProxy: tc.proxy,
+			Logger:            log.New(os.Stdout, "", log.LstdFlags),
+		}}
+
+		buf := bytes.NewBuffer(nil)
+		buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, tc.port})
+		req, err := NewRequest(buf, socks5Version)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp := &MockConn{}
+		if err := s.handleRequest(req, resp); err == nil {
+			t.Fatalf("expected error")
+		}
+
+		out := resp.buf.Bytes()
+		expected := []byte{5, tc.reply, 0, 1, 0, 0, 0, 0, 0, 0}
+		if !bytes.Equal(out, expected) {
+			t.Fatalf("bad: %v %v", out, expected)
+		}
+	}
+}
+
+func TestUpstreamHTTPProxy_InvalidHost(t *testing.T) {
+	upstream := startHTTPProxy(t, "foo", "bar")
+	host := "example.com\r\nX-Injected: 1"
+
+	// The name is refused when the request is read
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, ConnectCommand, 0, FqdnAddress, byte(len(host))})
+	buf.WriteString(host)
+	buf.Write([]byte{0, 80})
+	if _, err := NewRequest(buf, socks5Version); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// And never written to the upstream proxy, whatever produced it
+	s := &Server{config: &Config{UpstreamHTTPProxy: "http://foo:bar@" + upstream}}
+	conn, err := s.dialHTTPProxy(context.Background(), "tcp", net.JoinHostPort(host, "80"))
+	if err == nil {
+		conn.Close()
+		t.Fatalf("expected error")
+	}
+}
+
+func TestConfig_Validate_UpstreamHTTPProxy(t *testing.T) {
+	for _, proxy := range []string{"socks5://127.0.0.1:1080", "http://", "://"} {
+		conf := &Config{UpstreamHTTPProxy: proxy}
+		if err := conf.Validate(); err == nil {
+			t.Fatalf("expected error for %q", proxy)
+		}
+	}
+}
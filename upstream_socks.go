@@ -0,0 +1,87 @@
+package socks
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// parseSOCKS5ProxyURL is used to validate Config.UpstreamSOCKS5Proxy
+func parseSOCKS5ProxyURL(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" {
+		return nil, fmt.Errorf("unsupported scheme: %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+	return u, nil
+}
+
+// upstreamAuth returns the credentials used with the upstream SOCKS5
+// proxy for req, if any
+func (s *Server) upstreamAuth(u *url.URL, req *Request) *UsernamePassword {
+	var auth *UsernamePassword
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &UsernamePassword{Username: u.User.Username(), Password: password}
+	}
+	if s.config.PropagateAuthUpstream && req.AuthContext != nil {
+		if user := req.AuthContext.Payload["Username"]; user != "" {
+			if auth == nil {
+				auth = &UsernamePassword{}
+			}
+			auth.Username = user
+		}
+	}
+	return auth
+}
+
+// dialSOCKS5Proxy connects to addr through the upstream SOCKS5 proxy
+func (s *Server) dialSOCKS5Proxy(ctx context.Context, network, addr string, req *Request) (net.Conn, error) {
+	u, err := parseSOCKS5ProxyURL(s.config.UpstreamSOCKS5Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy: %v", err)
+	}
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		proxyAddr = net.JoinHostPort(u.Hostname(), "1080")
+	}
+	dest, err := parseDialAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d := net.Dialer{Control: s.socketControl()}
+	conn, err := d.DialContext(ctx, network, proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Honor the context during the handshake
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	compress := s.config.RelayCompression != nil
+	compressed, err := clientHandshakeV5Compress(conn, dest, s.upstreamAuth(u, req), compress)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+	if compressed {
+		cc, err := newCompressedConn(s.config.RelayCompression, conn, nil)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("upstream proxy: compression: %w", err)
+		}
+		return cc, nil
+	}
+	return conn, nil
+}
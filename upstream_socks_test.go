@@ -0,0 +1,56 @@
+package socks
+
+import (
+	"log"
+	"os"
+	"sync"
+	"testing"
+)
+
+// recordingCredentials accepts any user with the given password, and
+// records the users seen
+type recordingCredentials struct {
+	password string
+
+	mu    sync.Mutex
+	users []string
+}
+
+func (c *recordingCredentials) Valid(user, password string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users = append(c.users, user)
+	return password == c.password
+}
+
+func TestUpstreamSOCKS5Proxy_PropagateAuth(t *testing.T) {
+	echoAddr := startEchoServer(t)
+
+	upstreamCreds := &recordingCredentials{password: "secret"}
+	upstream := startServer(t, &Config{
+		Credentials: upstreamCreds,
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+	})
+
+	for _, propagate := range []bool{false, true} {
+		proxyAddr := startServer(t, &Config{
+			Credentials:           StaticCredentials{"alice": "wonderland"},
+			UpstreamSOCKS5Proxy:   "socks5://proxy:secret@" + upstream,
+			PropagateAuthUpstream: propagate,
+			Logger:                log.New(os.Stdout, "", log.LstdFlags),
+		})
+
+		conn, err := Dial("tcp", proxyAddr, echoAddr, &UsernamePassword{Username: "alice", Password: "wonderland"})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		testEcho(t, conn)
+		conn.Close()
+	}
+
+	upstreamCreds.mu.Lock()
+	defer upstreamCreds.mu.Unlock()
+	if len(upstreamCreds.users) != 2 || upstreamCreds.users[0] != "proxy" || upstreamCreds.users[1] != "alice" {
+		t.Fatalf("bad: %v", upstreamCreds.users)
+	}
+}
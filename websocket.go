@@ -0,0 +1,67 @@
+package socks
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+// ServeWebSocket is used to serve SOCKS clients tunneling over a
+// WebSocket, such as browser-based tools, so that the proxy can be
+// embedded in an HTTP server. The SOCKS stream is carried in binary
+// frames. Browsers are only accepted from the origin of the proxy, or
+// from one listed in Config.WebSocketOrigins. Clients sending no
+// Origin, which are not browsers, are accepted too
+func (s *Server) ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	websocket.Server{Handshake: s.checkWebSocketOrigin, Handler: func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		conn := &webSocketConn{Conn: ws}
+		if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+			conn.remote = addr
+		}
+		if err := s.ServeConn(conn); err != nil {
+			s.config.Logger.Printf("%s", err)
+		}
+	}}.ServeHTTP(w, r)
+}
+
+// checkWebSocketOrigin is a WebSocket handshake check accepting
+// requests with no Origin header, or one of the proxy itself or listed
+// in Config.WebSocketOrigins
+func (s *Server) checkWebSocketOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return fmt.Errorf("invalid origin %q: %v", origin, err)
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return nil
+	}
+	for _, allowed := range s.config.WebSocketOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), strings.TrimSuffix(origin, "/")) {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %q not allowed", origin)
+}
+
+// webSocketConn reports the address of the HTTP client as its remote
+// address, where a WebSocket reports the origin
+type webSocketConn struct {
+	*websocket.Conn
+	remote net.Addr
+}
+
+func (c *webSocketConn) RemoteAddr() net.Addr {
+	if c.remote == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remote
+}
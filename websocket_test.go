@@ -0,0 +1,121 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
+)
+
+func TestServeWebSocket(t *testing.T) {
+	target := startEchoServer(t)
+	tAddr, _ := net.ResolveTCPAddr("tcp", target)
+
+	var source *AddrSpec
+	s, err := New(&Config{
+		AcceptRequest: func(ctx context.Context, req *Request) (bool, uint8) {
+			source = req.RemoteAddr
+			return true, 0
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	hs := httptest.NewServer(http.HandlerFunc(s.ServeWebSocket))
+	defer hs.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(hs.URL, "http"), "", hs.URL)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer ws.Close()
+	ws.PayloadType = websocket.BinaryFrame
+	ws.SetDeadline(time.Now().Add(time.Second))
+
+	req := bytes.NewBuffer([]byte{5, 1, NoAuth, 5, ConnectCommand, 0, Ipv4Address, 127, 0, 0, 1})
+	binary.Write(req, binary.BigEndian, uint16(tAddr.Port))
+	if _, err := ws.Write(req.Bytes()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := make([]byte, 2+10)
+	if _, err := io.ReadFull(ws, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out[:4], []byte{5, NoAuth, 5, SuccessReply}) {
+		t.Fatalf("bad: %v", out)
+	}
+	testEcho(t, ws)
+
+	// Rules see the HTTP client address
+	if source == nil || !source.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("bad: %v", source)
+	}
+}
+
+func TestServeWebSocket_Origin(t *testing.T) {
+	s, err := New(&Config{WebSocketOrigins: []string{"https://tools.example.com"}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	hs := httptest.NewServer(http.HandlerFunc(s.ServeWebSocket))
+	defer hs.Close()
+
+	for _, tc := range []struct {
+		origin string
+		status int
+	}{
+		// Clients that are not browsers send no Origin
+		{"", http.StatusSwitchingProtocols},
+		{hs.URL, http.StatusSwitchingProtocols},
+		{"https://TOOLS.example.com/", http.StatusSwitchingProtocols},
+		{"https://evil.example.com", http.StatusForbidden},
+		{"http://tools.example.com", http.StatusForbidden},
+	} {
+		// websocket.Dial always sends an Origin, so handshake by hand
+		conn, err := net.Dial("tcp", strings.TrimPrefix(hs.URL, "http://"))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+
+		req, _ := http.NewRequest("GET", hs.URL, nil)
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		if err := req.Write(conn); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.Close()
+		if resp.StatusCode != tc.status {
+			t.Fatalf("bad: %q: %v", tc.origin, resp.Status)
+		}
+	}
+
+	// "*" accepts any origin
+	s.config.WebSocketOrigins = []string{"*"}
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(hs.URL, "http"), "", "https://evil.example.com")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ws.Close()
+}